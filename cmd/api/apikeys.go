@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"net/http"
+	"time"
+)
+
+// Authenticates the request with an API key. The user is granted the
+// permissions of the key that the owner still holds.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, keyPlaintext string) (*http.Request, bool) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidCredentialsPresented(w, r)
+		return r, false
+	}
+
+	key, user, err := app.models.APIKeys.GetWithUser(r.Context(), keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsPresented(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return r, false
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return r, false
+	}
+
+	// Keep track of when the key was last used. A failure here
+	// shouldn't prevent the request from being served.
+	err = app.models.APIKeys.Touch(r.Context(), key.ID)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, key.Permissions.Intersect(permissions))
+	return r, true
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+
+	v := validator.New()
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A key can't be granted more than its owner has.
+	permissions, ok := app.contextGetPermissions(r)
+	if !ok {
+		permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	for _, code := range key.Permissions {
+		if !permissions.Include(code) {
+			v.AddError("permissions", "must only contain permissions you hold")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.APIKeys.Insert(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAPIKeyName):
+			v.AddError("name", "an api key with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"github.com/felixge/httpsnoop"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reasons for which clients are banned automatically.
+const (
+	banReasonRateLimit = "rate_limit"
+	banReasonAuth      = "authentication_failures"
+)
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejects clients on the deny list and banned clients, and records the
+// offences of clients that exceed the rate limit or fail to authenticate, which
+// flushStrikes turns into bans. Clients on the allow list are never denied or
+// banned.
+func (app *application) ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := app.clientIP(r)
+		ip := net.ParseIP(clientIP)
+
+		if ip != nil && ipInNetworks(ip, app.config.ipFilter.allow) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ip != nil && ipInNetworks(ip, app.config.ipFilter.deny) {
+			app.blockedClientResponse(w, r)
+			return
+		}
+		ban, err := app.models.Bans.Get(r.Context(), clientIP)
+		switch {
+		case err == nil:
+			retryAfter := int(math.Ceil(time.Until(ban.Expiry).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			app.blockedClientResponse(w, r)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			// An unavailable database shouldn't turn every client away.
+			app.logError(r, err)
+		}
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		switch metrics.Code {
+		case http.StatusTooManyRequests:
+			if app.config.ipFilter.rateLimitThreshold > 0 {
+				app.models.Bans.Strike(clientIP, banReasonRateLimit)
+			}
+		case http.StatusUnauthorized:
+			if app.config.ipFilter.authFailureThreshold > 0 {
+				app.models.Bans.Strike(clientIP, banReasonAuth)
+			}
+		}
+	})
+}
+
+func (app *application) listBansHandler(w http.ResponseWriter, r *http.Request) {
+	bans, err := app.models.Bans.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bans": bans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createBanHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IP       string `json:"ip"`
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	ip := net.ParseIP(input.IP)
+	v.Check(ip != nil, "ip", "must be a valid IP address")
+	duration, err := time.ParseDuration(input.Duration)
+	v.Check(err == nil && duration > 0, "duration", "must be a positive duration such as 30m or 24h")
+	v.Check(len(input.Reason) <= 200, "reason", "must not be more than 200 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := time.Now()
+	ban := &data.Ban{IP: ip.String(), Reason: input.Reason, Expiry: now.Add(duration), Manual: true, CreatedAt: now}
+	err = app.models.Bans.Insert(r.Context(), ban)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"ban": ban}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteBanHandler(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(httprouter.ParamsFromContext(r.Context()).ByName("ip"))
+	if ip == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Bans.Delete(r.Context(), ip.String())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ban successfully lifted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
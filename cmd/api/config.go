@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ol-ilyassov/spa_final/internal/conffile"
+	"github.com/ol-ilyassov/spa_final/internal/jsonlog"
+	"github.com/ol-ilyassov/spa_final/internal/jwt"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables are named after flags with this prefix, in upper case
+// and with underscores, e.g. MUSIC_CLUB_DB_DSN for -db-dsn.
+const envPrefix = "MUSIC_CLUB_"
+
+// Flags holding secrets. Each of them can also be read from the file named by
+// the flag with a "-file" suffix, e.g. -db-dsn-file, and is redacted by -print-config.
+var secretFlags = []string{"db-dsn", "smtp-password", "oidc-client-secret", "jwt-keys"}
+
+// A flag parsed by a function, like flag.Func, which remembers its value so
+// that it can be printed.
+type funcValue struct {
+	value string
+	parse func(string) error
+}
+
+func (f *funcValue) String() string {
+	return f.value
+}
+
+func (f *funcValue) Set(value string) error {
+	err := f.parse(value)
+	if err != nil {
+		return err
+	}
+	f.value = value
+	return nil
+}
+
+// Defines a flag parsed by fn, which is applied to the default value right away.
+func funcFlag(fs *flag.FlagSet, name, value, usage string, fn func(string) error) {
+	f := &funcValue{parse: fn}
+	if value != "" {
+		err := f.Set(value)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fs.Var(f, name, usage)
+}
+
+// Defines the flags of all settings, which are stored in cfg as they are parsed.
+func configFlags(cfg *config, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	funcFlag(fs, "log-level", "info", "Minimum level of log entries (info|error|fatal|off)", func(val string) error {
+		var err error
+		cfg.logLevel, err = jsonlog.ParseLevel(val)
+		return err
+	})
+	funcFlag(fs, "disabled-features", "", "Features turned off (space separated), see features", func(val string) error {
+		disabled := make(map[string]bool)
+		for _, name := range strings.Fields(val) {
+			if !validator.In(name, features...) {
+				return fmt.Errorf("unknown feature %q", name)
+			}
+			disabled[name] = true
+		}
+		cfg.disabledFeatures = disabled
+		return nil
+	})
+	fs.String("config", "", "Configuration file, also read from MUSIC_CLUB_CONFIG")
+	fs.Bool("print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Rate limiter backend, postgres shares limits between instances (memory|postgres)")
+	fs.Float64Var(&cfg.limiter.writeRPS, "limiter-write-rps", 1, "Rate limiter maximum write requests per second")
+	fs.IntVar(&cfg.limiter.writeBurst, "limiter-write-burst", 2, "Rate limiter maximum write burst")
+	fs.Float64Var(&cfg.limiter.authRPS, "limiter-auth-rps", 0.1, "Rate limiter maximum login requests per second")
+	fs.IntVar(&cfg.limiter.authBurst, "limiter-auth-burst", 5, "Rate limiter maximum login burst")
+	funcFlag(fs, "limiter-tiers", "", "Rate limit multipliers for users with a permission, as space separated permission=factor pairs", func(val string) error {
+		var tiers []rateLimitTier
+		for _, pair := range strings.Fields(val) {
+			i := strings.LastIndex(pair, "=")
+			if i < 1 {
+				return errors.New("tiers must be given as permission=factor")
+			}
+			factor, err := strconv.ParseFloat(pair[i+1:], 64)
+			if err != nil || factor < 1 {
+				return errors.New("tier factors must be numbers of at least 1")
+			}
+			tiers = append(tiers, rateLimitTier{permission: pair[:i], factor: factor})
+		}
+		cfg.limiter.tiers = tiers
+		return nil
+	})
+
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "RIG <no-reply@rig.mail.net>", "SMTP sender")
+
+	funcFlag(fs, "cors-trusted-origins", "", "Trusted CORS origins (space separated), with * for a host label or ~ for a regular expression", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+	funcFlag(fs, "cors-allowed-methods", "OPTIONS PUT PATCH DELETE", "CORS allowed methods (space separated)", func(val string) error {
+		cfg.cors.allowedMethods = strings.Fields(val)
+		return nil
+	})
+	funcFlag(fs, "cors-allowed-headers", "Authorization Content-Type", "CORS allowed request headers (space separated)", func(val string) error {
+		cfg.cors.allowedHeaders = strings.Fields(val)
+		return nil
+	})
+	funcFlag(fs, "cors-exposed-headers", "", "Response headers exposed to CORS requests (space separated)", func(val string) error {
+		cfg.cors.exposedHeaders = strings.Fields(val)
+		return nil
+	})
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 0, "How long browsers may cache CORS preflight responses (0 omits the header)")
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests")
+
+	funcFlag(fs, "trusted-proxies", "", "Trusted reverse proxy CIDRs (space separated)", func(val string) error {
+		var err error
+		cfg.proxy.trusted, err = parseCIDRs(val)
+		return err
+	})
+	funcFlag(fs, "proxy-header", "X-Forwarded-For", "Forwarding header written by the trusted proxies, the only one read (X-Forwarded-For|Forwarded|X-Real-IP)", func(val string) error {
+		cfg.proxy.header = http.CanonicalHeaderKey(val)
+		return nil
+	})
+
+	funcFlag(fs, "ip-allow", "", "Client CIDRs that are never denied or banned (space separated)", func(val string) error {
+		var err error
+		cfg.ipFilter.allow, err = parseCIDRs(val)
+		return err
+	})
+	funcFlag(fs, "ip-deny", "", "Client CIDRs that are always rejected (space separated)", func(val string) error {
+		var err error
+		cfg.ipFilter.deny, err = parseCIDRs(val)
+		return err
+	})
+	fs.IntVar(&cfg.ipFilter.rateLimitThreshold, "ban-rate-limit-threshold", 50, "Rate limited requests within the ban window that get a client banned (0 disables)")
+	fs.IntVar(&cfg.ipFilter.authFailureThreshold, "ban-auth-failure-threshold", 20, "Failed authentications within the ban window that get a client banned (0 disables)")
+	fs.DurationVar(&cfg.ipFilter.window, "ban-window", 10*time.Minute, "Period over which offences leading to bans are counted")
+	fs.DurationVar(&cfg.ipFilter.banDuration, "ban-duration", time.Hour, "Automatic ban duration")
+
+	fs.DurationVar(&cfg.users.unactivatedTTL, "users-unactivated-ttl", 7*24*time.Hour, "Delete unactivated accounts after this period (0 disables)")
+
+	fs.IntVar(&cfg.login.maxAttempts, "login-max-attempts", 10, "Failed logins before an account is locked")
+	fs.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "Account lockout duration")
+
+	fs.StringVar(&cfg.tokens.mode, "tokens-mode", tokenModeDatabase, "Authentication token mode (database|jwt)")
+	fs.DurationVar(&cfg.tokens.authenticationTTL, "tokens-authentication-ttl", 24*time.Hour, "Authentication token lifetime")
+	fs.DurationVar(&cfg.tokens.refreshTTL, "tokens-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+
+	fs.DurationVar(&cfg.oauth.tokenTTL, "oauth-token-ttl", time.Hour, "OAuth access token lifetime")
+
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect provider issuer URL")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client id")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	fs.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "http://localhost:4000/v1/oidc/callback", "OpenID Connect redirect URL")
+
+	fs.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "Token and permission lookup cache TTL (0 disables)")
+
+	funcFlag(fs, "jwt-keys", "", "Signing keys for signed tokens as space separated kid:secret pairs, the first one is used for signing", func(val string) error {
+		var keys []jwt.Key
+		for _, pair := range strings.Fields(val) {
+			i := strings.Index(pair, ":")
+			if i < 1 || len(pair)-i-1 < 32 {
+				return errors.New("keys must be given as kid:secret with a secret of at least 32 bytes")
+			}
+			keys = append(keys, jwt.Key{ID: pair[:i], Secret: []byte(pair[i+1:])})
+		}
+		cfg.jwt.keys = keys
+		return nil
+	})
+	fs.DurationVar(&cfg.jwt.ttl, "jwt-ttl", 15*time.Minute, "Signed token lifetime")
+	fs.StringVar(&cfg.jwt.issuer, "jwt-issuer", "music-club", "Signed token issuer")
+
+	fs.StringVar(&cfg.tracing.exporter, "tracing-exporter", "none", "Where spans are sent (none|stdout|otlp)")
+	fs.StringVar(&cfg.tracing.otlpEndpoint, "tracing-otlp-endpoint", "http://localhost:4318", "OpenTelemetry collector accepting OTLP over HTTP")
+	fs.Float64Var(&cfg.tracing.sampleRatio, "tracing-sample-ratio", 1, "Share of new traces that are recorded, between 0 and 1")
+
+	for _, name := range secretFlags {
+		fs.String(name+"-file", "", "File to read "+name+" from")
+	}
+
+	return fs
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Parses the configuration from, in increasing order of precedence, the file
+// named by -config or MUSIC_CLUB_CONFIG, environment variables and
+// command-line arguments.
+func loadConfig(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	settings := make(map[string]string)
+
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fileSettings, err := conffile.Parse(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for name, value := range fileSettings {
+			if name == "config" || name == "print-config" || fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+			settings[name] = value
+		}
+	}
+
+	env := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			env[f.Name] = value
+		}
+	})
+	overrideSecrets(settings, func(name string) bool {
+		_, ok := env[name]
+		return ok
+	})
+	for name, value := range env {
+		settings[name] = value
+	}
+	overrideSecrets(settings, func(name string) bool { return explicit[name] })
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		err := fs.Set(name, settings[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+
+	for _, name := range secretFlags {
+		path := fs.Lookup(name + "-file").Value.String()
+		if path == "" {
+			continue
+		}
+		if _, ok := settings[name]; ok || explicit[name] {
+			return fmt.Errorf("only one of %s and %s-file may be set", name, name)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = fs.Set(name, strings.TrimRight(string(content), "\r\n"))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Removes secrets from settings for which given reports that they are set
+// in a higher layer, either directly or through a file.
+func overrideSecrets(settings map[string]string, given func(name string) bool) {
+	for _, name := range secretFlags {
+		if given(name) || given(name+"-file") {
+			delete(settings, name)
+			delete(settings, name+"-file")
+		}
+	}
+}
+
+// Returns the values of all settings, by flag name.
+func configValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" || strings.HasSuffix(f.Name, "-file") {
+			return
+		}
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// Hides the value of a setting if it is a secret.
+func redact(name, value string) string {
+	if value != "" && validator.In(name, secretFlags...) {
+		return "[redacted]"
+	}
+	return value
+}
+
+// Writes the effective configuration in the configuration file format, with
+// secrets redacted.
+func printConfig(fs *flag.FlagSet, w io.Writer) {
+	values := configValues(fs)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, strconv.Quote(redact(name, values[name])))
+	}
+}
+
+// Checks the configuration, returning an error message for each invalid setting.
+func (cfg config) validate() map[string]string {
+	v := validator.New()
+
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be a valid TCP port")
+	v.Check(validator.In(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns >= 0, "db-max-open-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil, "db-max-idle-time", "must be a duration such as 15m")
+
+	v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be positive")
+	v.Check(cfg.limiter.burst >= 1, "limiter-burst", "must be at least 1")
+	v.Check(cfg.limiter.writeRPS > 0, "limiter-write-rps", "must be positive")
+	v.Check(cfg.limiter.writeBurst >= 1, "limiter-write-burst", "must be at least 1")
+	v.Check(cfg.limiter.authRPS > 0, "limiter-auth-rps", "must be positive")
+	v.Check(cfg.limiter.authBurst >= 1, "limiter-auth-burst", "must be at least 1")
+	v.Check(validator.In(cfg.limiter.backend, "memory", "postgres"), "limiter-backend", "must be memory or postgres")
+
+	v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+	v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be a valid TCP port")
+	v.Check(cfg.smtp.sender != "", "smtp-sender", "must be provided")
+
+	v.Check(validator.In(cfg.proxy.header, "X-Forwarded-For", "Forwarded", "X-Real-Ip"), "proxy-header", "must be X-Forwarded-For, Forwarded or X-Real-IP")
+
+	v.Check(cfg.ipFilter.rateLimitThreshold >= 0, "ban-rate-limit-threshold", "must not be negative")
+	v.Check(cfg.ipFilter.authFailureThreshold >= 0, "ban-auth-failure-threshold", "must not be negative")
+	v.Check(cfg.ipFilter.window > 0, "ban-window", "must be positive")
+	v.Check(cfg.ipFilter.banDuration > 0, "ban-duration", "must be positive")
+
+	v.Check(cfg.cors.maxAge >= 0, "cors-max-age", "must not be negative")
+	v.Check(cfg.users.unactivatedTTL >= 0, "users-unactivated-ttl", "must not be negative")
+	v.Check(cfg.login.maxAttempts >= 1, "login-max-attempts", "must be at least 1")
+	v.Check(cfg.login.lockoutDuration > 0, "login-lockout-duration", "must be positive")
+	v.Check(cfg.cache.ttl >= 0, "cache-ttl", "must not be negative")
+
+	v.Check(validator.In(cfg.tokens.mode, tokenModeDatabase, tokenModeJWT), "tokens-mode", "must be database or jwt")
+	v.Check(cfg.tokens.authenticationTTL > 0, "tokens-authentication-ttl", "must be positive")
+	v.Check(cfg.tokens.refreshTTL > 0, "tokens-refresh-ttl", "must be positive")
+	v.Check(cfg.oauth.tokenTTL > 0, "oauth-token-ttl", "must be positive")
+	if cfg.tokens.mode == tokenModeJWT {
+		v.Check(len(cfg.jwt.keys) > 0, "jwt-keys", "must be provided when tokens-mode is jwt")
+		v.Check(cfg.jwt.ttl > 0, "jwt-ttl", "must be positive")
+		v.Check(cfg.jwt.issuer != "", "jwt-issuer", "must be provided")
+	}
+
+	v.Check(validator.In(cfg.tracing.exporter, "none", "stdout", "otlp"), "tracing-exporter", "must be none, stdout or otlp")
+	v.Check(cfg.tracing.sampleRatio >= 0 && cfg.tracing.sampleRatio <= 1, "tracing-sample-ratio", "must be between 0 and 1")
+	if cfg.tracing.exporter == "otlp" {
+		u, err := url.Parse(cfg.tracing.otlpEndpoint)
+		v.Check(err == nil && u.Scheme != "" && u.Host != "", "tracing-otlp-endpoint", "must be an absolute URL")
+	}
+
+	if cfg.oidc.issuer != "" {
+		u, err := url.Parse(cfg.oidc.issuer)
+		v.Check(err == nil && u.Scheme != "" && u.Host != "", "oidc-issuer", "must be an absolute URL")
+		v.Check(cfg.oidc.clientID != "", "oidc-client-id", "must be provided when oidc-issuer is set")
+		v.Check(cfg.oidc.clientSecret != "", "oidc-client-secret", "must be provided when oidc-issuer is set")
+		u, err = url.Parse(cfg.oidc.redirectURL)
+		v.Check(err == nil && u.Scheme != "" && u.Host != "", "oidc-redirect-url", "must be an absolute URL")
+	}
+
+	return v.Errors
+}
+
+var errInvalidConfig = errors.New("invalid configuration")
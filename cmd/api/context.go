@@ -12,6 +12,22 @@ type contextKey string
 // getting and setting user information in the request context.
 const userContextKey = contextKey("user")
 
+// Key for the plaintext token the request was authenticated with.
+const tokenContextKey = contextKey("token")
+
+// Key for permissions that came with the credentials, so they don't have to be looked up.
+const permissionsContextKey = contextKey("permissions")
+
+// Keys for the scopes granted to a third-party application acting on behalf
+// of the user, and for marking routes that such applications may access.
+const (
+	scopesContextKey            = contextKey("scopes")
+	delegationAllowedContextKey = contextKey("delegationAllowed")
+)
+
+// Key for the address of the client, which may be behind proxies.
+const clientIPContextKey = contextKey("clientIP")
+
 // Returns a new copy of the request with the provided User struct added to the context.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -26,3 +42,64 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// Returns a new copy of the request with the plaintext authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, tokenPlaintext string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, tokenPlaintext)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the plaintext authentication token from the request context.
+// Returns an empty string if the request was not authenticated with a token.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// Returns a new copy of the request with the user's permissions added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the user's permissions from the request context.
+// The boolean is false if they have to be looked up in the database.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// Returns a new copy of the request with the OAuth scopes granted to the client added to the context.
+func (app *application) contextSetScopes(r *http.Request, scopes data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), scopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the OAuth scopes from the request context.
+// The boolean is false if the user is not acting through a third-party application.
+func (app *application) contextGetScopes(r *http.Request) (data.Permissions, bool) {
+	scopes, ok := r.Context().Value(scopesContextKey).(data.Permissions)
+	return scopes, ok
+}
+
+// Returns a new copy of the request marked as allowed for third-party applications.
+func (app *application) contextAllowDelegation(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), delegationAllowedContextKey, true)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextDelegationAllowed(r *http.Request) bool {
+	allowed, _ := r.Context().Value(delegationAllowedContextKey).(bool)
+	return allowed
+}
+
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the client address, or an empty string if realIP hasn't run.
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(clientIPContextKey).(string)
+	return ip
+}
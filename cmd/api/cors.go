@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cross-origin rules for a set of routes.
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     []*regexp.Regexp
+	methods     []string
+	headers     []string
+	exposed     []string
+	maxAge      time.Duration // Not sent if zero
+	credentials bool
+}
+
+// Compiles origin patterns, which are one of:
+//   - "*", allowing every origin;
+//   - an exact origin, such as "https://example.com";
+//   - an origin with "*" standing for a single host label, such as "https://*.preview.example.com";
+//   - a regular expression prefixed with "~", matched against the whole origin,
+//     such as "~https://pr-[0-9]+\.preview\.example\.com".
+func newCORSPolicy(patterns []string) (*corsPolicy, error) {
+	p := &corsPolicy{}
+	for _, pattern := range patterns {
+		var expr string
+		switch {
+		case pattern == "*":
+			p.anyOrigin = true
+			continue
+		case strings.HasPrefix(pattern, "~"):
+			expr = pattern[1:]
+		default:
+			expr = strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `[A-Za-z0-9-]+`)
+		}
+		rx, err := regexp.Compile(`^(?:` + expr + `)$`)
+		if err != nil {
+			return nil, errors.New("invalid CORS origin pattern " + strconv.Quote(pattern))
+		}
+		p.origins = append(p.origins, rx)
+	}
+	return p, nil
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	for _, rx := range p.origins {
+		if rx.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the default policy of the API, built from the configuration.
+func (cfg config) corsPolicy() (*corsPolicy, error) {
+	p, err := newCORSPolicy(cfg.cors.trustedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	if p.anyOrigin && cfg.cors.allowCredentials {
+		return nil, errors.New("CORS credentials can't be allowed for every origin")
+	}
+	p.methods = cfg.cors.allowedMethods
+	p.headers = cfg.cors.allowedHeaders
+	p.exposed = cfg.cors.exposedHeaders
+	p.maxAge = cfg.cors.maxAge
+	p.credentials = cfg.cors.allowCredentials
+	return p, nil
+}
+
+// Adds CORS headers for allowed origins, and answers their preflight requests.
+// Routes listed in overrides follow their own policy instead of the default one
+// of the live configuration.
+func (app *application) enableCORS(overrides map[string]*corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		p := app.liveConfig().cors
+		if override, ok := overrides[r.URL.Path]; ok {
+			p = override
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !p.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// If request has the HTTP method OPTIONS and "Access-Control-Request-Method" header,
+		// then it as a preflight request.
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.headers, ", "))
+			if p.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if len(p.exposed) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.exposed, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -7,10 +7,17 @@ import (
 
 // Helper (Method) for logging an error message.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.logger.PrintError(err, traceProperties(r, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+		"client_ip":      app.clientIP(r),
+	}))
+}
+
+// Helper (Method) for logging an informational message about a request, with
+// the ids of its trace.
+func (app *application) logInfo(r *http.Request, message string, properties map[string]string) {
+	app.logger.PrintInfo(message, traceProperties(r, properties))
 }
 
 // Generic helper (Method) for sending JSON-formatted error
@@ -60,6 +67,11 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) blockedClientResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your IP address has been blocked from accessing this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -80,7 +92,31 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) suspendedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) sessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be logged in with your own session, not an api key or application token, to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// Sends an error in the format of RFC 6749 section 5.2, expected by OAuth clients.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	env := envelope{"error": code, "error_description": description}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -1,22 +1,206 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+// Timeout of each readiness check.
+const healthCheckTimeout = 2 * time.Second
 
+// How long the result of the SMTP check is reused, so that frequent probes
+// don't open a connection to the mail server each time.
+const smtpHealthTTL = 30 * time.Second
+
+// How long the result of the database check is reused. The health endpoints
+// are public and not rate limited, so probes mustn't reach the database each time.
+const dbHealthTTL = 5 * time.Second
+
+var errWorkerStopped = errors.New("stopped")
+
+// Outcome of one readiness check. Failing critical checks make the instance
+// unavailable, others only degrade it. Errors are logged rather than
+// reported, as the endpoints are public.
+type healthCheck struct {
+	Status   string            `json:"status"` // pass or fail
+	Critical bool              `json:"critical"`
+	Duration string            `json:"duration,omitempty"`
+	Details  map[string]string `json:"details,omitempty"` // Status of each part
+	errs     map[string]error  // By part, or under "" for the check as a whole
+}
+
+func newHealthCheck(critical bool, start time.Time, err error) healthCheck {
+	check := healthCheck{Status: "pass", Critical: critical, Duration: time.Since(start).String()}
+	if err != nil {
+		check.Status = "fail"
+		check.errs = map[string]error{"": err}
+	}
+	return check
+}
+
+// Last known state of the long-running background workers.
+type workerHealth struct {
+	mu      sync.Mutex
+	workers map[string]workerState
+}
+
+type workerState struct {
+	running bool
+	err     error // Of the last run or connection attempt
+}
+
+func newWorkerHealth() *workerHealth {
+	return &workerHealth{workers: make(map[string]workerState)}
+}
+
+// Records the state of a worker, which is healthy if it runs without error.
+func (h *workerHealth) report(name string, running bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.workers[name] = workerState{running: running, err: err}
+}
+
+// Reports whether every worker is healthy, with the status of each by name.
+func (h *workerHealth) check() healthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	check := healthCheck{Status: "pass", Details: make(map[string]string), errs: make(map[string]error)}
+	for name, state := range h.workers {
+		err := state.err
+		if err == nil && !state.running {
+			err = errWorkerStopped
+		}
+		if err != nil {
+			check.Status = "fail"
+			check.Details[name] = "fail"
+			check.errs[name] = err
+			continue
+		}
+		check.Details[name] = "pass"
+	}
+	return check
+}
+
+// Result of a check that is reused for a while.
+type cachedCheck struct {
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+func (c *cachedCheck) run(ttl time.Duration, check func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > ttl {
+		c.err = check()
+		c.checked = time.Now()
+	}
+	return c.err
+}
+
+func (app *application) isShuttingDown() bool {
+	return atomic.LoadInt32(&app.shuttingDown) == 1
+}
+
+// Reports that the process is up and serving requests.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
-		"status": "available",
+		"status": "alive",
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
 		},
 	}
 
-	// Return type: []byte
 	err := app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// Reports whether the instance can serve traffic, with the outcome of each
+// check. Responds with 503 Service Unavailable if a critical check fails,
+// including as soon as the server starts shutting down.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]healthCheck)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	run := func(name string, critical bool, check func(ctx context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			mu.Lock()
+			checks[name] = newHealthCheck(critical, start, err)
+			mu.Unlock()
+		}()
+	}
+
+	run("database", true, func(ctx context.Context) error {
+		return app.dbHealth.run(dbHealthTTL, func() error {
+			// Not bound to the request, as the result is shared with later probes.
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			return app.db.PingContext(ctx)
+		})
+	})
+	run("smtp", false, func(ctx context.Context) error {
+		return app.smtpHealth.run(smtpHealthTTL, func() error {
+			// Not bound to the request, as the result is shared with later probes.
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			return app.mailer.Ping(ctx)
+		})
+	})
+	wg.Wait()
+
+	checks["workers"] = app.workers.check()
+
+	shutdown := healthCheck{Status: "pass", Critical: true}
+	if app.isShuttingDown() {
+		shutdown.Status = "fail"
+	}
+	checks["shutdown"] = shutdown
+
+	status, code := "ready", http.StatusOK
+	for name, check := range checks {
+		if check.Status == "pass" {
+			continue
+		}
+		for part, err := range check.errs {
+			properties := map[string]string{"check": name}
+			if part != "" {
+				properties["part"] = part
+			}
+			app.logger.PrintError(err, traceProperties(r, properties))
+		}
+		switch {
+		case check.Critical:
+			status, code = "unavailable", http.StatusServiceUnavailable
+		case status == "ready":
+			status = "degraded"
+		}
+	}
+
+	env := envelope{
+		"status": status,
+		"checks": checks,
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+
+	err := app.writeJSON(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Retrieve "id" URL parameter from request context
@@ -136,11 +138,45 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// Returns the IP address of the client that sent the request.
+func (app *application) clientIP(r *http.Request) string {
+	if ip := app.contextGetClientIP(r); ip != "" {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// Parses space separated CIDRs, where single addresses stand for themselves.
+func parseCIDRs(val string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Fields(val) {
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, errors.New("networks must be given as CIDRs or IP addresses")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	atomic.AddInt64(&app.backgroundTasks, 1)
 
 	go func() {
 		defer app.wg.Done()
+		defer atomic.AddInt64(&app.backgroundTasks, -1)
 
 		// Recover any panic.
 		defer func() {
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"strconv"
+	"time"
+)
+
+// Names of the background workers, as reported by readiness checks.
+const (
+	workerUnactivatedUsers   = "unactivated_users_cleanup"
+	workerCacheInvalidations = "cache_invalidation_listener"
+	workerRevocations        = "revocation_listener"
+)
+
+// Periodically deletes accounts that were never activated within the configured period.
+// Runs until the done channel is closed.
+func (app *application) deleteUnactivatedUsers(done <-chan struct{}) {
+	if app.config.users.unactivatedTTL <= 0 {
+		return
+	}
+	defer app.workers.report(workerUnactivatedUsers, false, nil)
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := app.models.Users.DeleteUnactivatedBefore(context.Background(), time.Now().Add(-app.config.users.unactivatedTTL))
+		app.workers.report(workerUnactivatedUsers, true, err)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		} else if deleted > 0 {
+			app.logger.PrintInfo("deleted unactivated users", map[string]string{
+				"count": strconv.FormatInt(deleted, 10),
+			})
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Periodically writes when tokens were last used, which authenticate only
+// records in memory. Runs until the done channel is closed.
+func (app *application) flushTokenUsage(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := app.models.Tokens.FlushUsage(context.Background())
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+}
+
+// Periodically deletes expired bans, and offences outside of the ban window.
+// Runs until the done channel is closed.
+func (app *application) deleteExpiredBans(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := app.models.Bans.DeleteExpired(context.Background(), app.config.ipFilter.window)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+}
+
+// Periodically writes the offences ipFilter records in memory, and bans the
+// clients that reached a threshold. Runs until the done channel is closed.
+func (app *application) flushStrikes(done <-chan struct{}) {
+	thresholds := map[string]int{
+		banReasonRateLimit: app.config.ipFilter.rateLimitThreshold,
+		banReasonAuth:      app.config.ipFilter.authFailureThreshold,
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			bans, err := app.models.Bans.FlushStrikes(context.Background(), thresholds, app.config.ipFilter.window, app.config.ipFilter.banDuration)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+			for _, ban := range bans {
+				app.logger.PrintInfo("client banned", map[string]string{
+					"ip":     ban.IP,
+					"reason": ban.Reason,
+					"until":  ban.Expiry.Format(time.RFC3339),
+				})
+			}
+		}
+	}
+}
+
+// Applies the cache invalidations announced by every instance, including this
+// one, through Postgres LISTEN/NOTIFY. Runs until the done channel is closed.
+func (app *application) listenForCacheInvalidations(done <-chan struct{}) {
+	cache := app.models.Users.Cache
+	if cache == nil {
+		return
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		app.workers.report(workerCacheInvalidations, true, err)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(data.CacheInvalidationChannel)
+	if err != nil {
+		app.workers.report(workerCacheInvalidations, false, err)
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.workers.report(workerCacheInvalidations, true, nil)
+	defer app.workers.report(workerCacheInvalidations, false, nil)
+
+	for {
+		select {
+		case <-done:
+			return
+		case n := <-listener.Notify:
+			// A nil notification follows a reconnection, after which
+			// invalidations may have been missed.
+			if n == nil {
+				cache.Flush()
+				continue
+			}
+			cache.Apply(n.Extra)
+		case <-time.After(time.Minute):
+			go listener.Ping()
+		}
+	}
+}
+
+// Applies the revocations of signed tokens announced by every instance,
+// including this one, through Postgres LISTEN/NOTIFY. Runs until the done
+// channel is closed.
+func (app *application) listenForRevocations(done <-chan struct{}) {
+	if app.revoked == nil {
+		return
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		app.workers.report(workerRevocations, true, err)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(data.RevocationChannel)
+	if err != nil {
+		app.workers.report(workerRevocations, false, err)
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.workers.report(workerRevocations, true, nil)
+	defer app.workers.report(workerRevocations, false, nil)
+
+	// Revocations made before listening started, or while reconnecting, are
+	// read from the database.
+	reload := func() {
+		revocations, err := app.models.Revocations.GetAll(context.Background())
+		if err != nil {
+			app.workers.report(workerRevocations, true, err)
+			app.logger.PrintError(err, nil)
+			return
+		}
+		app.revoked.load(revocations)
+	}
+	reload()
+
+	for {
+		select {
+		case <-done:
+			return
+		case n := <-listener.Notify:
+			if n == nil {
+				reload()
+				continue
+			}
+			err := app.revoked.apply(n.Extra)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		case <-time.After(time.Minute):
+			go listener.Ping()
+		}
+	}
+}
+
+// Periodically deletes revocations of signed tokens that have expired anyway.
+// Runs until the done channel is closed.
+func (app *application) deleteExpiredRevocations(done <-chan struct{}) {
+	if app.revoked == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			app.revoked.prune(app.config.jwt.ttl)
+			err := app.models.Revocations.DeleteExpired(context.Background())
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+}
+
+// Periodically deletes logins at the identity provider that were abandoned.
+// Runs until the done channel is closed.
+func (app *application) deleteExpiredOIDCLogins(done <-chan struct{}) {
+	if app.oidc == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := app.models.OIDCLogins.DeleteExpired(context.Background())
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Number of failed logins tolerated before progressive delays kick in.
+const loginDelayThreshold = 3
+
+// Returns how long a user has to wait after the last failed login before
+// trying again. The delay doubles with every failure past the threshold.
+func (app *application) loginDelay(failedCount int) time.Duration {
+	if failedCount < loginDelayThreshold {
+		return 0
+	}
+	delay := app.config.login.lockoutDuration
+	if shift := failedCount - loginDelayThreshold; shift < 16 && time.Second<<shift < delay {
+		delay = time.Second << shift
+	}
+	return delay
+}
+
+// Reports whether login attempts are currently refused for the user.
+func (app *application) loginBlocked(attempts *data.LoginAttempts) bool {
+	now := time.Now()
+	return attempts.Locked(now) || now.Before(attempts.LastFailedAt.Add(app.loginDelay(attempts.FailedCount)))
+}
+
+// Counts a failed login and locks the account once too many have failed,
+// letting the owner know by email.
+func (app *application) recordFailedLogin(r *http.Request, user *data.User) error {
+	ctx := r.Context()
+	attempts, err := app.models.Logins.RecordFailure(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if attempts.FailedCount < app.config.login.maxAttempts || attempts.Locked(time.Now()) {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(app.config.login.lockoutDuration)
+	err = app.models.Logins.Lock(ctx, user.ID, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	app.logInfo(r, "account locked after failed logins", map[string]string{
+		"user_id":      strconv.FormatInt(user.ID, 10),
+		"failed_count": strconv.Itoa(attempts.FailedCount),
+	})
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"failedCount": attempts.FailedCount,
+			"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+		}
+		// Send the lockout notification email.
+		err := app.sendEmail(trace.Detach(ctx), user.Email, "account_locked.tmpl", data)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	return nil
+}
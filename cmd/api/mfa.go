@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/totp"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"net/http"
+	"time"
+)
+
+// Name shown by authenticator apps next to the account.
+const totpIssuer = "Music-Club"
+
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if current != nil && current.Confirmed {
+		v := validator.New()
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.SetTOTP(r.Context(), user.ID, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Enrollment is confirmed with a code from the authenticator app.
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	current, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if current.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, valid := totp.Validate(current.Secret, input.Code, time.Now())
+	if !valid {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	_, err = app.models.MFA.UseTOTPStep(r.Context(), user.ID, step)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	recoveryCodes, err := data.NewRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFA.ConfirmTOTP(r.Context(), user.ID, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Recovery codes are only stored hashed, so this is the only time they are shown.
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Disabling two-factor authentication requires the current password.
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.MFA.DeleteTOTP(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchanges the challenge token returned by createAuthenticationTokenHandler
+// and a TOTP or recovery code for authentication tokens.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"mfa_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+		Refresh        bool   `json:"refresh"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeMFA, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A challenge allows a single attempt, so codes can't be guessed
+	// without going through the password check again.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeMFA, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Wrong codes count as failed logins, and lock the account just the same.
+	attempts, err := app.models.Logins.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if app.loginBlocked(attempts) {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	var valid bool
+	if input.RecoveryCode != "" {
+		valid, err = app.models.MFA.UseRecoveryCode(r.Context(), user.ID, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		current, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if current != nil && current.Confirmed {
+			var step int64
+			step, valid = totp.Validate(current.Secret, input.Code, time.Now())
+			if valid {
+				valid, err = app.models.MFA.UseTOTPStep(r.Context(), user.ID, step)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+		}
+	}
+	if !valid {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if attempts.FailedCount > 0 {
+		err = app.models.Logins.Reset(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	env, err := app.issueLoginTokens(r, user, input.Refresh)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -6,16 +6,23 @@ import (
 	"fmt"
 	"github.com/felixge/httpsnoop"
 	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/jwt"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
-	"golang.org/x/time/rate"
-	"net"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
+// Stores the address of the client in the request context, looking past
+// trusted proxies.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, app.forwardedClientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -30,63 +37,39 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	// Hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mu.Lock()
-			// Loop through all clients. If they haven't been seen within the last three
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
+func isHealthCheck(path string) bool {
+	return path == "/v1/healthcheck" || strings.HasPrefix(path, "/v1/health/")
+}
 
-	// This is a closure, which 'closes over' the limiter variable.
+// Limits requests per route group, by user for authenticated requests and by
+// IP address otherwise. Health checks are exempt, as probes are frequent.
+// Must run after authenticate.
+func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		if app.config.limiter.enabled {
-			// Extract the client's IP address from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if app.liveConfig().limiter.enabled && !isHealthCheck(r.URL.Path) {
+			key, policy, err := app.rateLimitPolicy(r)
 			if err != nil {
 				app.serverErrorResponse(w, r, err)
 				return
 			}
-			mu.Lock()
-			// If IP address dont exist in map, then initialize a new rate limiter
-			//and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-				}
-			}
 
-			clients[ip].lastSeen = time.Now()
+			result, err := app.limiter.Allow(r.Context(), key, policy)
+			if err != nil {
+				// An unavailable limiter backend shouldn't take the API down with it.
+				app.logError(r, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
 
-			// Call the Allow() method on the rate limiter for the current IP address.
 			// If not allowed, then 429 Too Many Requests response.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			if !result.Allowed {
+				app.instruments.rateLimited.WithLabelValues(rateLimitGroup(r)).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			mu.Unlock()
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -105,32 +88,77 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Clients that keep presenting invalid credentials are turned away
+		// before any lookup. Limits per user only apply once authenticated.
+		if !app.allowCredentialCheck(w, r) {
+			return
+		}
+
 		headerParts := strings.Split(authorizationHeader, " ")
+		// API keys of service accounts use their own scheme.
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			r, ok := app.authenticateAPIKey(w, r, headerParts[1])
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+			app.invalidCredentialsPresented(w, r)
 			return
 		}
 
 		token := headerParts[1]
 
+		// Signed tokens carry everything needed to authenticate the user.
+		if app.signer != nil && jwt.LooksLikeToken(token) {
+			claims, err := app.verifySignedToken(token)
+			if err != nil {
+				app.invalidCredentialsPresented(w, r)
+				return
+			}
+			userID, err := claims.userID()
+			if err != nil {
+				app.invalidCredentialsPresented(w, r)
+				return
+			}
+			r = app.contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+			r = app.contextSetPermissions(r, claims.Permissions)
+			r = app.contextSetToken(r, token)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+			app.invalidCredentialsPresented(w, r)
 			return
 		}
 		// Retrieve the details of the user associated with the authentication token.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			// Tokens of third-party applications also carry the scopes they were granted.
+			var scopes data.Permissions
+			user, scopes, err = app.models.OAuth.GetForAccessToken(r.Context(), token)
+			if err == nil {
+				r = app.contextSetScopes(r, scopes)
+			}
+		}
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				app.invalidCredentialsPresented(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
+		// Keep track of when the session was last used.
+		app.models.Tokens.Touch(token)
 		// Add the user information to the request context.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		next.ServeHTTP(w, r)
 	})
@@ -144,6 +172,16 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 			app.authenticationRequiredResponse(w, r)
 			return
 		}
+		// Suspended users are refused whatever their credentials, API keys included.
+		if user.Suspended {
+			app.suspendedAccountResponse(w, r)
+			return
+		}
+		// Third-party applications may only use routes guarded by a permission.
+		if _, delegated := app.contextGetScopes(r); delegated && !app.contextDelegationAllowed(r) {
+			app.notPermittedResponse(w, r)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -163,49 +201,52 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// Checks that an activated user is logged in with a session of their own,
+// for routes that manage credentials. API keys, which carry no token, and
+// tokens of third-party applications are refused, so that they can't be used
+// to create credentials that outlive or outrank them.
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, delegated := app.contextGetScopes(r); delegated || app.contextGetToken(r) == "" {
+			app.sessionRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	// Wrap with requireActivatedUser().
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// Get the slice of permissions for the user, unless they came with the credentials.
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 		if !permissions.Include(code) {
 			app.notPermittedResponse(w, r) // 403 Forbidden response.
 			return
 		}
+		// Third-party applications also need the permission to be in their scopes.
+		if scopes, delegated := app.contextGetScopes(r); delegated && !scopes.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
 		// Next handler in the chain.
 		next.ServeHTTP(w, r)
 	}
 	// Wrap with requireActivatedUser().
-	return app.requireActivatedUser(fn)
-}
-
-func (app *application) enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Vary", "Origin")
-		w.Header().Add("Vary", "Access-Control-Request-Method")
-		origin := r.Header.Get("Origin")
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					// If request has the HTTP method OPTIONS and "Access-Control-Request-Method" header,
-					// then it as a preflight request.
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						// Set the necessary preflight response headers
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-						w.WriteHeader(http.StatusOK)
-						return
-					}
-				}
-			}
-		}
-		next.ServeHTTP(w, r)
-	})
+	activated := app.requireActivatedUser(fn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		activated(w, app.contextAllowDelegation(r))
+	}
 }
 
 func (app *application) metrics(next http.Handler) http.Handler {
@@ -217,6 +258,9 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
+		// The router records the matched route, so that requests are labeled
+		// by pattern rather than by URL.
+		r, rt := app.contextSetRoute(r)
 		// Returns the metrics struct of handlers.
 		metrics := httpsnoop.CaptureMetrics(next, w, r)
 
@@ -226,5 +270,18 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
 		// Increment the count for specific status code by 1.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		pattern := rt.pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		// Clients can send any method, which mustn't create series without bound.
+		method := r.Method
+		if !validator.In(method, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions) {
+			method = "OTHER"
+		}
+		status := strconv.Itoa(metrics.Code)
+		app.instruments.requests.WithLabelValues(method, pattern, status).Inc()
+		app.instruments.requestDuration.WithLabelValues(method, pattern, status).Observe(metrics.Duration.Seconds())
 	})
 }
@@ -35,7 +35,7 @@ func (app *application) createMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Musics.Insert(music)
+	err = app.models.Musics.Insert(r.Context(), music)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -56,7 +56,7 @@ func (app *application) showMusicHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	music, err := app.models.Musics.Get(id)
+	music, err := app.models.Musics.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -80,7 +80,7 @@ func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	music, err := app.models.Musics.Get(id)
+	music, err := app.models.Musics.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,7 +121,7 @@ func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Musics.Update(music)
+	err = app.models.Musics.Update(r.Context(), music)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -146,7 +146,7 @@ func (app *application) deleteMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Musics.Delete(id)
+	err = app.models.Musics.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -185,7 +185,7 @@ func (app *application) listMusicsHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	musics, metadata, err := app.models.Musics.GetAll(input.Title, input.Author, input.Filters)
+	musics, metadata, err := app.models.Musics.GetAll(r.Context(), input.Title, input.Author, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Lifetime of authorization codes. They are exchanged right after the redirect.
+const oauthCodeTTL = time.Minute
+
+func (app *application) registerOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"` // Clients that can't keep a secret, such as mobile apps
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		UserID:       user.ID,
+	}
+
+	permissions, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuth.InsertClient(r.Context(), client, input.Public)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuth.GetClientsForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := app.models.OAuth.DeleteClient(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Parameters of an authorization request, see RFC 6749 section 4.1.1 and RFC 7636.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Checks an authorization request and returns the client it is for.
+func (app *application) validateAuthorizationRequest(ctx context.Context, v *validator.Validator, req authorizationRequest) (*data.OAuthClient, error) {
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	data.ValidateCodeChallenge(v, req.CodeChallenge, req.CodeChallengeMethod)
+
+	client, err := app.models.OAuth.GetClient(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			v.AddError("client_id", "unknown client")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	v.Check(validator.In(req.RedirectURI, client.RedirectURIs...), "redirect_uri", "is not registered for this client")
+
+	scopes := strings.Fields(req.Scope)
+	v.Check(len(scopes) > 0, "scope", "must be provided")
+	for _, scope := range scopes {
+		v.Check(client.Scopes.Include(scope), "scope", "must only contain scopes registered for this client")
+	}
+
+	return client, nil
+}
+
+// Describes an authorization request so that the user can be asked for consent.
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	req := authorizationRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+
+	v := validator.New()
+	client, err := app.validateAuthorizationRequest(r.Context(), v, req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{
+		"client": map[string]string{
+			"client_id": client.ID,
+			"name":      client.Name,
+		},
+		"scopes": strings.Fields(req.Scope),
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Records the user's decision on an authorization request and returns the
+// URI to redirect the user agent to, carrying either a code or an error.
+func (app *application) approveAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	client, err := app.validateAuthorizationRequest(r.Context(), v, input.authorizationRequest)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	params := url.Values{}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	if input.Approve {
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        user.ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        strings.Fields(input.Scope),
+			CodeChallenge: input.CodeChallenge,
+		}
+		err = app.models.OAuth.NewCode(r.Context(), code, oauthCodeTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		params.Set("code", code.Plaintext)
+	} else {
+		params.Set("error", "access_denied")
+	}
+
+	redirect, err := url.Parse(input.RedirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	query := redirect.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	redirect.RawQuery = query.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirect.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Token endpoint of RFC 6749 section 4.1.3, exchanging an authorization code
+// and its PKCE verifier for an access token.
+func (app *application) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Limit the size of request body to 1MB
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant is supported")
+		return
+	}
+
+	// Clients authenticate with HTTP Basic or form parameters.
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuth.GetClient(r.Context(), clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if client.Confidential() && !client.SecretMatches(clientSecret) {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	verifier := r.PostForm.Get("code_verifier")
+	v := validator.New()
+	if data.ValidateCodeVerifier(v, verifier); !v.Valid() {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "code_verifier "+v.Errors["code_verifier"])
+		return
+	}
+
+	code, err := app.models.OAuth.ConsumeCode(r.Context(), r.PostForm.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") || !code.VerifierMatches(verifier) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+		return
+	}
+
+	token, err := app.models.OAuth.NewAccessToken(r.Context(), code.UserID, client.ID, code.Scopes, app.config.oauth.tokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Responses carrying tokens must not be cached, see RFC 6749 section 5.1.
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.oauth.tokenTTL.Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+	}
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
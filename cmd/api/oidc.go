@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/oidc"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a user has to complete the login at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// Returns a random URL-safe string.
+func randomString() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// Starts a login at the identity provider, returning the URL of its login page.
+func (app *application) startOIDCLogin(r *http.Request, linkUserID int64) (string, error) {
+	login := &data.OIDCLogin{LinkUserID: linkUserID}
+	state, err := randomString()
+	if err == nil {
+		login.Nonce, err = randomString()
+	}
+	if err == nil {
+		login.CodeVerifier, err = randomString()
+	}
+	if err != nil {
+		return "", err
+	}
+	login.Expiry = time.Now().Add(oidcLoginTTL)
+
+	hash := sha256.Sum256([]byte(login.CodeVerifier))
+	url, err := app.oidc.AuthCodeURL(r.Context(), state, login.Nonce, base64.RawURLEncoding.EncodeToString(hash[:]))
+	if err != nil {
+		return "", err
+	}
+
+	// Kept in the database, as the callback may reach another instance.
+	err = app.models.OIDCLogins.Insert(r.Context(), state, login)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// Redirects the user to the identity provider's login page.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	url, err := app.startOIDCLogin(r, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Returns the identity provider's login page for linking an identity to the
+// account of the logged in user. Accounts are never linked by email address,
+// as that would hand them to whoever controls the address at the provider.
+func (app *application) oidcLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	url, err := app.startOIDCLogin(r, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authorization_url": url}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Completes a login at the identity provider. A verified identity that isn't
+// linked to any user yet gets a new user, unless its email address is taken.
+// Logins then go through the lockout and two-factor checks of password logins.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+	login, err := app.models.OIDCLogins.Consume(r.Context(), qs.Get("state"))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err != nil || qs.Get("error") != "" || qs.Get("code") == "" {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), qs.Get("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		app.logError(r, err)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if login.LinkUserID != 0 {
+		app.completeOIDCLink(w, r, login.LinkUserID, claims)
+		return
+	}
+
+	user, err := app.models.Users.GetForIdentity(r.Context(), claims.Issuer, claims.Subject)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		// New users need an address the provider vouches for.
+		if !claims.EmailVerified || claims.Email == "" {
+			message := "your email address must be verified by the identity provider"
+			app.errorResponse(w, r, http.StatusForbidden, message)
+			return
+		}
+		user, err = app.createOIDCUser(r.Context(), claims.Issuer, claims.Subject, claims.Email, claims.Name)
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			message := "an account with this email address already exists, log in to it and link the identity provider first"
+			app.errorResponse(w, r, http.StatusConflict, message)
+			return
+		}
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	attempts, err := app.models.Logins.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if app.loginBlocked(attempts) {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.logInfo(r, "user authenticated with identity provider", map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+		"issuer":  claims.Issuer,
+	})
+
+	app.completeLogin(w, r, user, attempts, false)
+}
+
+// Links the identity to the user who started the login with oidcLinkHandler.
+func (app *application) completeOIDCLink(w http.ResponseWriter, r *http.Request, userID int64, claims *oidc.Claims) {
+	linked, err := app.models.Users.GetForIdentity(r.Context(), claims.Issuer, claims.Subject)
+	switch {
+	case err == nil:
+		if linked.ID != userID {
+			message := "this identity is already linked to another account"
+			app.errorResponse(w, r, http.StatusConflict, message)
+			return
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		err = app.models.Users.AddIdentity(r.Context(), userID, claims.Issuer, claims.Subject)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logInfo(r, "user linked identity provider", map[string]string{
+		"user_id": strconv.FormatInt(userID, 10),
+		"issuer":  claims.Issuer,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "identity provider successfully linked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Creates a user for an identity whose email address isn't taken yet.
+func (app *application) createOIDCUser(ctx context.Context, issuer, subject, email, name string) (*data.User, error) {
+	if name == "" {
+		name = email
+	}
+	user := &data.User{
+		Name:      name,
+		Email:     email,
+		Activated: true, // The provider has verified the address
+	}
+	// The user logs in through the provider, so the local password is
+	// random. It can be replaced through a password reset.
+	password, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Users.InsertWithIdentity(ctx, user, issuer, subject, data.RoleListener)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"sync/atomic"
+)
+
+// Key for the route of a request, which the metrics middleware adds before
+// routing and the router fills in.
+const routeContextKey = contextKey("route")
+
+type route struct {
+	pattern string // Such as /v1/musics/:id, empty if no route matched
+}
+
+// Prometheus metrics of the API, served on /metrics.
+type instruments struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	rateLimited     *prometheus.CounterVec
+	emailsSent      *prometheus.CounterVec
+	emailFailures   *prometheus.CounterVec
+}
+
+func (app *application) newInstruments() *instruments {
+	ins := &instruments{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Requests served, by route pattern.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to serve requests, by route pattern.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_rejections_total",
+			Help: "Requests rejected by the rate limiter, by route group.",
+		}, []string{"group"}),
+		emailsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mailer_emails_sent_total",
+			Help: "Emails sent, by template.",
+		}, []string{"template"}),
+		emailFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mailer_email_failures_total",
+			Help: "Emails that couldn't be sent, by template.",
+		}, []string{"template"}),
+	}
+
+	ins.registry.MustRegister(
+		ins.requests,
+		ins.requestDuration,
+		ins.rateLimited,
+		ins.emailsSent,
+		ins.emailFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(app.db, "musics"),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "background_tasks",
+			Help: "Background tasks in progress, such as sending emails.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&app.backgroundTasks))
+		}),
+	)
+
+	return ins
+}
+
+// Serves the metrics to Prometheus.
+func (ins *instruments) handler() http.Handler {
+	return promhttp.HandlerFor(ins.registry, promhttp.HandlerOpts{})
+}
+
+// Returns a new copy of the request with a route to be filled in by the
+// router, or the request itself if an outer middleware has already added one.
+func (app *application) contextSetRoute(r *http.Request) (*http.Request, *route) {
+	if rt, ok := r.Context().Value(routeContextKey).(*route); ok {
+		return r, rt
+	}
+	rt := &route{}
+	ctx := context.WithValue(r.Context(), routeContextKey, rt)
+	return r.WithContext(ctx), rt
+}
+
+// A router that records the pattern of the matched route in the request
+// context, as httprouter doesn't expose it.
+type patternRouter struct {
+	*httprouter.Router
+}
+
+func (pr patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	pr.Handler(method, path, handler)
+}
+
+func (pr patternRouter) Handler(method, path string, handler http.Handler) {
+	pr.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt, ok := r.Context().Value(routeContextKey).(*route); ok {
+			rt.pattern = path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// Sends an email, counting successes and failures.
+func (app *application) sendEmail(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	_, span := trace.Start(ctx, "mailer.Send")
+	defer span.End()
+	span.SetAttributes(attribute.String("mail.template", templateFile))
+
+	err := app.mailer.Send(recipient, templateFile, data)
+	if err != nil {
+		trace.RecordError(span, err)
+		app.instruments.emailFailures.WithLabelValues(templateFile).Inc()
+		return err
+	}
+	app.instruments.emailsSent.WithLabelValues(templateFile).Inc()
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+func (app *application) trustedProxy(ip net.IP) bool {
+	return ipInNetworks(ip, app.config.proxy.trusted)
+}
+
+// Derives the address of the client from the forwarding header added by
+// trusted proxies. The addresses are walked from the closest hop outwards,
+// and the first one that isn't a trusted proxy is the client. Headers from
+// anyone else are ignored, as they can be forged at will. So are the other
+// forwarding headers, which proxies pass on untouched from the client.
+func (app *application) forwardedClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return remote
+	}
+	if !app.trustedProxy(ip) {
+		return ip.String()
+	}
+
+	var hops []string
+	switch app.config.proxy.header {
+	case "Forwarded":
+		hops = parseForwarded(r.Header.Values("Forwarded"))
+	case "X-Real-Ip":
+		// Proxies replace the header, so only the last one is theirs.
+		if values := r.Header.Values("X-Real-Ip"); len(values) > 0 {
+			hops = []string{strings.TrimSpace(values[len(values)-1])}
+		}
+	default:
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseNodeIP(hops[i])
+		// Obfuscated or unknown addresses can't be followed any further.
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !app.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Returns the "for" parameters of RFC 7239 Forwarded headers, in order.
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.Index(pair, "=")
+				if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+					continue
+				}
+				hops = append(hops, strings.Trim(strings.TrimSpace(pair[i+1:]), `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// Parses a node of a forwarding header, which may carry a port and, for
+// IPv6, square brackets. Returns nil for anything that isn't an IP address.
+func parseNodeIP(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/ol-ilyassov/spa_final/internal/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Route groups with limits of their own.
+const (
+	rateLimitGroupRead  = "read"
+	rateLimitGroupWrite = "write"
+	rateLimitGroupAuth  = "auth"
+)
+
+// Routes that check credentials or send emails, and so are limited the most.
+// Other routes are grouped by method.
+var rateLimitAuthRoutes = map[string]bool{
+	"/v1/users":                 true,
+	"/v1/users/activated":       true,
+	"/v1/users/password":        true,
+	"/v1/users/email/confirmed": true,
+	"/v1/tokens/authentication": true,
+	"/v1/tokens/mfa":            true,
+	"/v1/tokens/refresh":        true,
+	"/v1/tokens/activation":     true,
+	"/v1/tokens/password-reset": true,
+	"/v1/oidc/login":            true,
+	"/v1/oidc/callback":         true,
+	"/oauth/token":              true,
+}
+
+// Users holding the permission get limits multiplied by the factor.
+type rateLimitTier struct {
+	permission string
+	factor     float64
+}
+
+func rateLimitGroup(r *http.Request) string {
+	switch {
+	case rateLimitAuthRoutes[r.URL.Path]:
+		return rateLimitGroupAuth
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return rateLimitGroupRead
+	default:
+		return rateLimitGroupWrite
+	}
+}
+
+// Returns the bucket key and the policy that apply to a request. Authenticated
+// users are limited by their id wherever they connect from, and everyone else
+// by IP address.
+func (app *application) rateLimitPolicy(r *http.Request) (string, ratelimit.Policy, error) {
+	group := rateLimitGroup(r)
+	limiter := app.liveConfig().limiter
+
+	var policy ratelimit.Policy
+	switch group {
+	case rateLimitGroupAuth:
+		policy = ratelimit.Policy{Rate: limiter.authRPS, Burst: limiter.authBurst}
+	case rateLimitGroupWrite:
+		policy = ratelimit.Policy{Rate: limiter.writeRPS, Burst: limiter.writeBurst}
+	default:
+		policy = ratelimit.Policy{Rate: limiter.rps, Burst: limiter.burst}
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return group + ":ip:" + app.clientIP(r), policy, nil
+	}
+	key := group + ":user:" + strconv.FormatInt(user.ID, 10)
+
+	if len(limiter.tiers) == 0 {
+		return key, policy, nil
+	}
+	permissions, ok := app.contextGetPermissions(r)
+	if !ok {
+		var err error
+		permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return "", ratelimit.Policy{}, err
+		}
+	}
+	factor := 1.0
+	for _, tier := range limiter.tiers {
+		if tier.factor > factor && permissions.Include(tier.permission) {
+			factor = tier.factor
+		}
+	}
+	return key, policy.Multiply(factor), nil
+}
+
+// Invalid credentials presented from an IP address are counted in a bucket of
+// their own, limited like the auth route group.
+func (app *application) credentialFailures(r *http.Request) (string, ratelimit.Policy) {
+	limiter := app.liveConfig().limiter
+	return "auth-failures:ip:" + app.clientIP(r), ratelimit.Policy{Rate: limiter.authRPS, Burst: limiter.authBurst}
+}
+
+// Reports whether the client may present credentials. Clients that have
+// presented too many invalid ones are sent a 429 Too Many Requests response,
+// before their credentials cost any lookups.
+func (app *application) allowCredentialCheck(w http.ResponseWriter, r *http.Request) bool {
+	if !app.liveConfig().limiter.enabled {
+		return true
+	}
+	key, policy := app.credentialFailures(r)
+	result, err := app.limiter.Peek(r.Context(), key, policy)
+	if err != nil {
+		// An unavailable limiter backend shouldn't take the API down with it.
+		app.logError(r, err)
+		return true
+	}
+	if !result.Allowed {
+		app.instruments.rateLimited.WithLabelValues(rateLimitGroupAuth).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// Responds to invalid credentials, counting them against the client's address.
+func (app *application) invalidCredentialsPresented(w http.ResponseWriter, r *http.Request) {
+	if app.liveConfig().limiter.enabled {
+		key, policy := app.credentialFailures(r)
+		_, err := app.limiter.Allow(r.Context(), key, policy)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+	app.invalidAuthenticationTokenResponse(w, r)
+}
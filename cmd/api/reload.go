@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Features which can be turned off with -disabled-features.
+var features = []string{
+	"registration", // Signing up for new accounts
+	"api-keys",     // Managing API keys
+	"oauth",        // Registering and authorizing third-party applications
+}
+
+// Flags which take effect when the configuration is reloaded. Others are only
+// read at startup.
+var reloadableFlags = map[string]bool{
+	"limiter-enabled":        true,
+	"limiter-rps":            true,
+	"limiter-burst":          true,
+	"limiter-write-rps":      true,
+	"limiter-write-burst":    true,
+	"limiter-auth-rps":       true,
+	"limiter-auth-burst":     true,
+	"limiter-tiers":          true,
+	"cors-trusted-origins":   true,
+	"cors-allowed-methods":   true,
+	"cors-allowed-headers":   true,
+	"cors-exposed-headers":   true,
+	"cors-max-age":           true,
+	"cors-allow-credentials": true,
+	"log-level":              true,
+	"disabled-features":      true,
+}
+
+// Settings that may change while the server runs. They are replaced as a
+// whole, so that requests see either the old or the new settings.
+type liveConfig struct {
+	limiter          limiterConfig
+	cors             *corsPolicy // Default cross-origin rules
+	disabledFeatures map[string]bool
+	values           map[string]string // All settings by flag name, as in effect
+}
+
+func newLiveConfig(cfg config, values map[string]string) (*liveConfig, error) {
+	cors, err := cfg.corsPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &liveConfig{
+		limiter:          cfg.limiter,
+		cors:             cors,
+		disabledFeatures: cfg.disabledFeatures,
+		values:           values,
+	}, nil
+}
+
+func (app *application) liveConfig() *liveConfig {
+	return app.live.Load().(*liveConfig)
+}
+
+// Responds as if the route didn't exist while the feature is turned off.
+func (app *application) requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.liveConfig().disabledFeatures[name] {
+			app.notFoundResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// Reads the configuration again and applies the settings that can change
+// without a restart. An invalid configuration is logged and leaves the
+// current settings untouched.
+func (app *application) reloadConfig() {
+	var cfg config
+	fs := configFlags(&cfg, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	err := loadConfig(fs, os.Args[1:])
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"action": "reload configuration"})
+		return
+	}
+	if errs := cfg.validate(); len(errs) > 0 {
+		app.logger.PrintError(errInvalidConfig, errs)
+		return
+	}
+
+	current := app.liveConfig()
+	values := configValues(fs)
+	changed := make(map[string]string)
+	var restartRequired []string
+	for name, value := range values {
+		old := current.values[name]
+		if value == old {
+			continue
+		}
+		if !reloadableFlags[name] {
+			// Keep reporting the setting until the server restarts.
+			values[name] = old
+			restartRequired = append(restartRequired, name)
+			continue
+		}
+		changed[name] = redact(name, old) + " -> " + redact(name, value)
+	}
+
+	live, err := newLiveConfig(cfg, values)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"action": "reload configuration"})
+		return
+	}
+	app.live.Store(live)
+	// Changes are logged at the more verbose of the old and new levels.
+	if cfg.logLevel < app.logger.Level() {
+		app.logger.SetLevel(cfg.logLevel)
+	}
+
+	if len(changed) == 0 {
+		app.logger.PrintInfo("configuration reloaded without changes", nil)
+	} else {
+		app.logger.PrintInfo("configuration reloaded", changed)
+	}
+	if len(restartRequired) > 0 {
+		sort.Strings(restartRequired)
+		app.logger.PrintInfo("configuration changes ignored until restart", map[string]string{
+			"settings": strings.Join(restartRequired, " "),
+		})
+	}
+	app.logger.SetLevel(cfg.logLevel)
+}
@@ -7,12 +7,14 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := patternRouter{httprouter.New()}
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.readinessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/health/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/health/ready", app.readinessHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/musics", app.requirePermission("musics:read", app.listMusicsHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/musics", app.requirePermission("musics:write", app.createMusicHandler))
@@ -20,11 +22,77 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPatch, "/v1/musics/:id", app.requirePermission("musics:write", app.updateMusicHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/musics/:id", app.requirePermission("musics:write", app.deleteMusicHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.requireFeature("registration", app.registerUserHandler))
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/confirmed", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireFeature("api-keys", app.requireSession(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireFeature("api-keys", app.requireSession(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireFeature("api-keys", app.requireSession(app.deleteAPIKeyHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/totp", app.requireSession(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mfa/totp", app.requireSession(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa/totp", app.requireSession(app.deleteTOTPHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tokens", app.requireSession(app.listAuthenticationTokensHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireSession(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/login", app.oidcLoginHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oidc/link", app.requireSession(app.oidcLinkHandler))
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireFeature("oauth", app.requireSession(app.listOAuthClientsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireFeature("oauth", app.requireSession(app.registerOAuthClientHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireFeature("oauth", app.requireSession(app.deleteOAuthClientHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireFeature("oauth", app.requireSession(app.showAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireFeature("oauth", app.requireSession(app.approveAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/oauth/token", app.requireFeature("oauth", app.oauthTokenHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:read", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:read", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:write", app.updateUserStatusHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:write", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:write", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:name", app.requirePermission("users:write", app.revokeUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/tokens", app.requirePermission("users:write", app.logoutUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:write", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/bans", app.requirePermission("users:read", app.listBansHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/bans", app.requirePermission("users:write", app.createBanHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/bans/:ip", app.requirePermission("users:write", app.deleteBanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:read", app.listRolesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("metrics:read", expvar.Handler().ServeHTTP))
+	router.HandlerFunc(http.MethodGet, "/metrics", app.requirePermission("metrics:read", app.instruments.handler().ServeHTTP))
+
+	// Browser-based OAuth clients exchange codes from their own origins, and never with cookies.
+	corsOverrides := map[string]*corsPolicy{
+		"/oauth/token": {anyOrigin: true, methods: []string{http.MethodPost}, headers: []string{"Authorization", "Content-Type"}},
+	}
+
+	// Middleware from the innermost to the outermost layer, each in its own span.
+	layers := []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+	}{
+		{"rateLimit", app.rateLimit},
+		{"authenticate", app.authenticate},
+		{"enableCORS", func(next http.Handler) http.Handler { return app.enableCORS(corsOverrides, next) }},
+		{"ipFilter", app.ipFilter},
+		{"recoverPanic", app.recoverPanic},
+		{"metrics", app.metrics},
+		{"realIP", app.realIP},
+	}
+	var handler http.Handler = router
+	for _, layer := range layers {
+		handler = app.traceLayer(layer.name, layer.middleware(handler))
+	}
+	return app.traceRequests(handler)
 }
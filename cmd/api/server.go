@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,6 +24,32 @@ func (app *application) serve() error {
 
 	// Graceful Shutdown
 	shutdownError := make(chan error) // Errors from Graceful Shutdown
+	done := make(chan struct{})       // Closed to stop periodic background jobs
+
+	go app.deleteUnactivatedUsers(done)
+	go app.listenForCacheInvalidations(done)
+	go app.flushTokenUsage(done)
+	go app.deleteExpiredBans(done)
+	go app.flushStrikes(done)
+	go app.listenForRevocations(done)
+	go app.deleteExpiredRevocations(done)
+	go app.deleteExpiredOIDCLogins(done)
+
+	// Reload the configuration on SIGHUP, keeping the listener and the
+	// requests in flight.
+	go func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		for {
+			select {
+			case <-hangup:
+				app.reloadConfig()
+			case <-done:
+				signal.Stop(hangup)
+				return
+			}
+		}
+	}()
 
 	go func() {
 		// Quit channel with os.Signal values.
@@ -32,10 +59,16 @@ func (app *application) serve() error {
 
 		s := <-quit
 
+		// Fail readiness checks right away, so that load balancers stop
+		// sending requests while the server drains.
+		atomic.StoreInt32(&app.shuttingDown, 1)
+
 		app.logger.PrintInfo("shutting down server", map[string]string{
 			"signal": s.String(),
 		})
 
+		close(done)
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -50,6 +83,20 @@ func (app *application) serve() error {
 
 		// nil = success, or error (, or 5-second context deadline)
 		app.wg.Wait()
+
+		// Write the token usage of the last requests.
+		err = app.models.Tokens.FlushUsage(ctx)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		// Export the spans of the last requests and background tasks.
+		if app.tracer != nil {
+			err = app.tracer.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
 		shutdownError <- nil
 	}()
 
@@ -80,4 +127,5 @@ func (app *application) serve() error {
 
 // SIGINT - signal: interrupt - [CTRL+C]
 // SIGTERM - signal: terminated
+// SIGHUP - signal: hangup, reloads the configuration
 // SIGKILL and SIGQUIT - no caught signal (killed).
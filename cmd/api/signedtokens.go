@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/jwt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token modes selected with the -tokens-mode flag.
+const (
+	tokenModeDatabase = "database" // Opaque tokens looked up in the tokens table
+	tokenModeJWT      = "jwt"      // Signed tokens verified without a database lookup
+)
+
+// Claims embedded in signed authentication tokens.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions"`
+	Family      string           `json:"fam,omitempty"` // Token family of the refresh token issued alongside
+}
+
+// Returns a signed authentication token for the user.
+func (app *application) newSignedToken(ctx context.Context, user *data.User, family []byte) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Subject:   strconv.FormatInt(user.ID, 10),
+			Issuer:    app.config.jwt.issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(app.config.jwt.ttl).Unix(),
+		},
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+	if family != nil {
+		claims.Family = base64.RawURLEncoding.EncodeToString(family)
+	}
+
+	plaintext, err := app.signer.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+		CreatedAt: now,
+	}, nil
+}
+
+// Verifies a signed authentication token and returns its claims.
+func (app *application) verifySignedToken(token string) (*accessClaims, error) {
+	var claims accessClaims
+	err := app.signer.Verify(token, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != app.config.jwt.issuer {
+		return nil, jwt.ErrInvalidToken
+	}
+	if app.revoked.isRevoked(&claims) {
+		return nil, jwt.ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+// Returns the id of the user the claims were issued to.
+func (c *accessClaims) userID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// Revoked signed tokens, recorded in the database and kept in memory by every
+// instance, which learns of the revocations of the others through LISTEN/NOTIFY.
+type revocationList struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time // Token id -> expiry
+	users  map[int64]time.Time  // User id -> tokens issued up to this time are revoked
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]time.Time),
+	}
+}
+
+// Adds the revocations read from the database.
+func (l *revocationList) load(revocations *data.Revocations) {
+	for id, expiry := range revocations.Tokens {
+		l.revokeToken(id, expiry)
+	}
+	for userID, revokedAt := range revocations.Users {
+		l.revokeUser(userID, revokedAt)
+	}
+}
+
+// Applies a revocation announced on data.RevocationChannel.
+func (l *revocationList) apply(payload string) error {
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid revocation %q", payload)
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid revocation %q", payload)
+	}
+	switch parts[0] {
+	case "token":
+		l.revokeToken(parts[1], time.Unix(unix, 0))
+	case "user":
+		userID, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid revocation %q", payload)
+		}
+		l.revokeUser(userID, time.Unix(unix, 0))
+	default:
+		return fmt.Errorf("invalid revocation %q", payload)
+	}
+	return nil
+}
+
+func (l *revocationList) revokeToken(id string, expiry time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens[id] = expiry
+}
+
+func (l *revocationList) revokeUser(userID int64, revokedAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if revokedAt.After(l.users[userID]) {
+		l.users[userID] = revokedAt
+	}
+}
+
+// Forgets revocations once every token they cover has expired.
+func (l *revocationList) prune(ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, expiry := range l.tokens {
+		if time.Now().After(expiry) {
+			delete(l.tokens, id)
+		}
+	}
+	for userID, revokedAt := range l.users {
+		if time.Since(revokedAt) > ttl {
+			delete(l.users, userID)
+		}
+	}
+}
+
+func (l *revocationList) isRevoked(claims *accessClaims) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.tokens[claims.ID]; found {
+		return true
+	}
+	userID, err := claims.userID()
+	if err != nil {
+		return true
+	}
+	if revokedAt, found := l.users[userID]; found && claims.IssuedAt <= revokedAt.Unix() {
+		return true
+	}
+	return false
+}
+
+// Revokes a signed token on every instance.
+func (app *application) revokeSignedToken(ctx context.Context, claims *accessClaims) error {
+	expiry := time.Unix(claims.ExpiresAt, 0)
+	err := app.models.Revocations.RevokeToken(ctx, claims.ID, expiry)
+	if err != nil {
+		return err
+	}
+	app.revoked.revokeToken(claims.ID, expiry)
+	return nil
+}
+
+// Revokes all signed tokens of the user on every instance. Does nothing in
+// database token mode.
+func (app *application) revokeSignedTokens(ctx context.Context, userID int64) error {
+	if app.revoked == nil {
+		return nil
+	}
+	revokedAt, err := app.models.Revocations.RevokeUser(ctx, userID, time.Now().Add(app.config.jwt.ttl))
+	if err != nil {
+		return err
+	}
+	app.revoked.revokeUser(userID, revokedAt)
+	return nil
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"github.com/ol-ilyassov/spa_final/internal/data"
+	"github.com/ol-ilyassov/spa_final/internal/jwt"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// Minimum time between two activation emails sent to the same user.
+const activationResendCooldown = 5 * time.Minute
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Refresh  bool   `json:"refresh"` // Also issue a long-lived refresh token
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -28,10 +36,12 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			// Respond no faster than for a wrong password.
+			data.SimulatePasswordCheck(input.Password)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -39,24 +49,433 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	attempts, err := app.models.Logins.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The password is checked even for blocked accounts, so that they
+	// can't be told apart from a wrong password by response time.
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if app.loginBlocked(attempts) {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
 	if !match {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Generate Token with 24 hour time.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	app.completeLogin(w, r, user, attempts, input.Refresh)
+}
+
+// Responds to a login whose first factor has been checked. Accounts with
+// two-factor authentication get a short-lived challenge token instead, which
+// is exchanged for the real tokens at /v1/tokens/mfa. Failed logins are only
+// forgotten once the second factor succeeds, so that codes can't be guessed
+// by getting a new challenge every time.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, attempts *data.LoginAttempts, refresh bool) {
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	totp, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if totp != nil && totp.Confirmed {
+		token, err := app.models.Tokens.NewForClient(r.Context(), user.ID, 5*time.Minute, data.ScopeMFA, nil, app.clientIP(r), r.UserAgent())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if attempts.FailedCount > 0 {
+		err = app.models.Logins.Reset(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env, err := app.issueLoginTokens(r, user, refresh)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generates the tokens for a successful login. A refresh token, if requested,
+// starts a new token family which all of its rotations will share.
+func (app *application) issueLoginTokens(r *http.Request, user *data.User, refresh bool) (envelope, error) {
+	var family []byte
+	if refresh {
+		var err error
+		family, err = data.NewTokenFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return app.issueAuthenticationTokens(r, user, family)
+}
+
+// Generates a new authentication token for the user. If a token family is
+// given, a refresh token belonging to the same family is generated as well.
+func (app *application) issueAuthenticationTokens(r *http.Request, user *data.User, family []byte) (envelope, error) {
+	var token *data.Token
+	var err error
+	if app.config.tokens.mode == tokenModeJWT {
+		token, err = app.newSignedToken(r.Context(), user, family)
+	} else {
+		token, err = app.models.Tokens.NewForClient(r.Context(), user.ID, app.config.tokens.authenticationTTL, data.ScopeAuthentication, family, app.clientIP(r), r.UserAgent())
+	}
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{"authentication_token": token}
+
+	if family != nil {
+		refreshToken, err := app.models.Tokens.NewForClient(r.Context(), user.ID, app.config.tokens.refreshTTL, data.ScopeRefresh, family, app.clientIP(r), r.UserAgent())
+		if err != nil {
+			return nil, err
+		}
+		env["refresh_token"] = refreshToken
+	}
+
+	return env, nil
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the plaintext refresh token from the request body.
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.GetByPlaintext(r.Context(), data.ScopeRefresh, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A refresh token can only be exchanged once. Seeing it again means it
+	// has leaked, so the whole family is revoked, including the tokens that
+	// were issued from it. Signed ones can only be revoked along with every
+	// other signed token of the user.
+	rotated, err := app.models.Tokens.Rotate(r.Context(), token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !rotated {
+		err = app.models.Tokens.DeleteFamily(r.Context(), token.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.revokeSignedTokens(r.Context(), token.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.logInfo(r, "refresh token reuse detected, token family revoked", map[string]string{
+			"user_id": strconv.FormatInt(token.UserID, 10),
+			"ip":      app.clientIP(r),
+		})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	env, err := app.issueAuthenticationTokens(r, user, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The same response is sent whether the email is known or not,
+	// so that this endpoint can't be used to find out which accounts exist.
+	env := envelope{"message": "if an account with that email address exists, an email will be sent to it containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Generate Password Reset Token with 45 minutes time.
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+		// Send the password reset email.
+		err = app.sendEmail(trace.Detach(r.Context()), user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Unknown, already activated and throttled emails all get the same response,
+	// so that this endpoint can't be used to find out which accounts exist.
+	env := envelope{"message": "if an unactivated account with that email address exists, an email will be sent to it containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && !user.Activated && !user.Deactivated() {
+		// Only one activation email per user is sent within the cooldown period.
+		recent, err := app.models.Tokens.ExistsSinceForUser(r.Context(), data.ScopeActivation, user.ID, time.Now().Add(-activationResendCooldown))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !recent {
+			// Generate Activation Token
+			token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.background(func() {
+				data := map[string]interface{}{
+					"activationToken": token.Plaintext,
+				}
+				// Send the activation email.
+				err := app.sendEmail(trace.Detach(r.Context()), user.Email, "token_activation.tmpl", data)
+				if err != nil {
+					app.logError(r, err)
+				}
+			})
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	current := app.contextGetToken(r)
+
+	tokens, err := app.models.Tokens.GetAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Describes an active session without exposing the token itself.
+	type session struct {
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		Expiry     time.Time  `json:"expiry"`
+		IP         string     `json:"ip"`
+		UserAgent  string     `json:"user_agent"`
+		Current    bool       `json:"current"`
+	}
+
+	sessions := make([]session, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, session{
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			Expiry:     token.Expiry,
+			IP:         token.IP,
+			UserAgent:  token.UserAgent,
+			Current:    current != "" && token.MatchesPlaintext(current),
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+	if token == "" {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	// The refresh token of the session is revoked along with it.
+	if app.signer != nil && jwt.LooksLikeToken(token) {
+		claims, err := app.verifySignedToken(token)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+		err = app.revokeSignedToken(r.Context(), claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if claims.Family != "" {
+			family, err := base64.RawURLEncoding.DecodeString(claims.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			err = app.models.Tokens.DeleteFamily(r.Context(), family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	} else {
+		err := app.models.Tokens.DeleteWithFamily(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeSignedTokens(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUserInScopes(r.Context(), user.ID, data.ScopeAuthentication, data.ScopeRefresh)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/felixge/httpsnoop"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+func (app *application) logTracingError(err error) {
+	app.logger.PrintError(err, map[string]string{"action": "export spans"})
+}
+
+// Returns a tracer provider recording the configured ratio of new traces,
+// which exports spans in batches, and installs it along with the W3C
+// traceparent propagator.
+func (app *application) newTracerProvider() (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch app.config.tracing.exporter {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		var u *url.URL
+		u, err = url.Parse(app.config.tracing.otlpEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		options := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(u.Host),
+			otlptracehttp.WithURLPath(path.Join("/", u.Path, "v1/traces")),
+		}
+		if u.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", app.config.tracing.exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(app.config.tracing.sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("music-club"),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(app.logTracingError))
+	return provider, nil
+}
+
+// Records a span for each request, continuing the trace of the client if the
+// request has a traceparent header.
+func (app *application) traceRequests(next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+	tracer := app.tracer.Tracer(trace.InstrumentationName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+			oteltrace.WithSpanKind(oteltrace.SpanKindServer),
+			oteltrace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path)),
+		)
+		defer span.End()
+
+		r, rt := app.contextSetRoute(r.WithContext(ctx))
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		if rt.pattern != "" {
+			span.SetName(r.Method + " " + rt.pattern)
+			span.SetAttributes(semconv.HTTPRouteKey.String(rt.pattern))
+		}
+		span.SetAttributes(
+			semconv.HTTPStatusCodeKey.Int(metrics.Code),
+			semconv.HTTPClientIPKey.String(app.forwardedClientIP(r)),
+		)
+		if metrics.Code >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("responded with status %d", metrics.Code))
+		}
+	})
+}
+
+// Runs a middleware layer within its own span, which includes the layers it
+// wraps.
+func (app *application) traceLayer(name string, next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := trace.Start(r.Context(), "middleware."+name)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the ids of the trace and span of a request, for log entries.
+func traceProperties(r *http.Request, properties map[string]string) map[string]string {
+	sc := oteltrace.SpanContextFromContext(r.Context())
+	if sc.IsValid() {
+		if properties == nil {
+			properties = make(map[string]string)
+		}
+		properties["trace_id"] = sc.TraceID().String()
+		properties["span_id"] = sc.SpanID().String()
+	}
+	return properties
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Minimal OpenID Connect provider for trying out the login flow locally.
+// Every login is approved right away as the user given by the flags.
+//
+//	go run ./cmd/examples/oidc/mockidp
+//	go run ./cmd/api -oidc-issuer=http://localhost:9000 -oidc-client-id=music-club -oidc-client-secret=secret
+//	curl -L localhost:4000/v1/oidc/login
+//
+// Existing accounts are linked from a logged in session, by following the
+// returned authorization_url:
+//
+//	curl -X POST -H "Authorization: Bearer <token>" localhost:4000/v1/oidc/link
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	issuer := flag.String("issuer", "http://localhost:9000", "Issuer URL, as seen by the API")
+	clientID := flag.String("client-id", "music-club", "Accepted client id")
+	clientSecret := flag.String("client-secret", "secret", "Accepted client secret")
+	email := flag.String("email", "alice@example.com", "Email of the logged in user")
+	name := flag.String("name", "Alice Smith", "Name of the logged in user")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Codes handed out by /authorize, waiting to be exchanged at /token.
+	type grant struct {
+		nonce         string
+		codeChallenge string
+		redirectURI   string
+	}
+	var (
+		mu     sync.Mutex
+		grants = make(map[string]grant)
+	)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                *issuer,
+			"authorization_endpoint":                *issuer + "/authorize",
+			"token_endpoint":                        *issuer + "/token",
+			"jwks_uri":                              *issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+		if qs.Get("client_id") != *clientID || qs.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		code := randomString()
+		mu.Lock()
+		grants[code] = grant{nonce: qs.Get("nonce"), codeChallenge: qs.Get("code_challenge"), redirectURI: qs.Get("redirect_uri")}
+		mu.Unlock()
+
+		redirect, err := url.Parse(qs.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+			return
+		}
+		q := redirect.Query()
+		q.Set("code", code)
+		q.Set("state", qs.Get("state"))
+		redirect.RawQuery = q.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != *clientID || secret != *clientSecret {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		code := r.PostFormValue("code")
+		mu.Lock()
+		g, found := grants[code]
+		delete(grants, code)
+		mu.Unlock()
+
+		hash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !found || g.redirectURI != r.PostFormValue("redirect_uri") || g.codeChallenge != base64.RawURLEncoding.EncodeToString(hash[:]) {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		idToken, err := sign(key, map[string]interface{}{
+			"iss":            *issuer,
+			"sub":            "mock|" + *email,
+			"aud":            *clientID,
+			"iat":            now.Unix(),
+			"exp":            now.Add(5 * time.Minute).Unix(),
+			"nonce":          g.nonce,
+			"email":          *email,
+			"email_verified": true,
+			"name":           *name,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"access_token": randomString(),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     idToken,
+		})
+	})
+
+	log.Printf("starting mock identity provider on %s", *addr)
+	err = http.ListenAndServe(*addr, mux)
+	log.Fatal(err)
+}
+
+// Returns an RS256 signed JWT with the claims.
+func sign(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,126 @@
+// Package conffile parses YAML configuration files into flat settings, so
+// that they can be applied like command-line flags.
+//
+// Nested keys are joined with dashes, and lists are joined with spaces:
+//
+//	port: 4000
+//	db:
+//	  dsn: "postgres://localhost/musics"   # becomes db-dsn
+//	cors:
+//	  trusted_origins:                     # becomes cors-trusted-origins
+//	    - https://example.com
+//	    - https://*.preview.example.com
+//	  allowed_methods: [GET, POST]
+//
+// Underscores in keys are read as dashes. Files hold a single document.
+package conffile
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var rxKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Parses a configuration file into settings keyed by their flat names.
+func Parse(r io.Reader) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	decoder := yaml.NewDecoder(r)
+	var doc yaml.Node
+	err := decoder.Decode(&doc)
+	switch {
+	case errors.Is(err, io.EOF):
+		return settings, nil // An empty file.
+	case err != nil:
+		return nil, err
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); !errors.Is(err, io.EOF) {
+		return nil, errors.New("configuration files must hold a single document")
+	}
+
+	root := doc.Content[0]
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return settings, nil // A file holding only comments.
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	err = flatten(settings, "", root)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Adds the settings of a mapping, with their keys prefixed by its own.
+func flatten(settings map[string]string, prefix string, node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], resolve(node.Content[i+1])
+
+		if keyNode.Kind != yaml.ScalarNode || !rxKey.MatchString(keyNode.Value) {
+			return fmt.Errorf("line %d: invalid key %q", keyNode.Line, keyNode.Value)
+		}
+		key := strings.ReplaceAll(keyNode.Value, "_", "-")
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+
+		switch valueNode.Kind {
+		case yaml.MappingNode:
+			err := flatten(settings, key, valueNode)
+			if err != nil {
+				return err
+			}
+			continue
+		case yaml.ScalarNode:
+			// A key without a value, such as an empty section.
+			if valueNode.Tag == "!!null" {
+				continue
+			}
+		}
+
+		if _, ok := settings[key]; ok {
+			return fmt.Errorf("line %d: duplicate key %q", keyNode.Line, key)
+		}
+		value, err := scalarValue(valueNode)
+		if err != nil {
+			return err
+		}
+		settings[key] = value
+	}
+	return nil
+}
+
+// Returns a scalar, or a list of scalars joined with spaces.
+func scalarValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			item = resolve(item)
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: list items must be scalars", item.Line)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, " "), nil
+	default:
+		return "", fmt.Errorf("line %d: unsupported value", node.Line)
+	}
+}
+
+// Follows aliases to the nodes they refer to.
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"time"
+)
+
+var (
+	ErrDuplicateAPIKeyName = errors.New("duplicate api key name")
+)
+
+// Long-lived credential for service accounts, limited to a subset of its owner's permissions.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"` // Only known when the key is created
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"` // nil for keys that never expire
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// Generates the plaintext and hash of a new key.
+func (k *APIKey) generate() error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	k.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(k.Plaintext))
+	k.Hash = hash[:]
+	return nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(len(keyPlaintext) == 52, "key", "must be 52 bytes long")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Generates a new key and stores its hash. The plaintext is only available on the returned value.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	ctx, span := trace.Start(ctx, "APIKeyModel.Insert")
+	defer span.End()
+
+	err := key.generate()
+	if err != nil {
+		return err
+	}
+
+	query :=
+		`INSERT INTO api_keys (user_id, name, hash, permissions, expiry) VALUES ($1, $2, $3, $4, $5)
+         RETURNING id, created_at`
+	args := []interface{}{key.UserID, key.Name, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "api_keys_user_id_name_key"`:
+			return ErrDuplicateAPIKeyName
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns all keys of a user, including expired ones.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	ctx, span := trace.Start(ctx, "APIKeyModel.GetAllForUser")
+	defer span.End()
+
+	query :=
+		`SELECT id, user_id, name, permissions, expiry, created_at, last_used_at FROM api_keys
+         WHERE user_id = $1
+         ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			pq.Array((*[]string)(&key.Permissions)),
+			&key.Expiry,
+			&key.CreatedAt,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Returns the unexpired key with the given plaintext together with its owner.
+func (m APIKeyModel) GetWithUser(ctx context.Context, keyPlaintext string) (*APIKey, *User, error) {
+	ctx, span := trace.Start(ctx, "APIKeyModel.GetWithUser")
+	defer span.End()
+
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query :=
+		`SELECT api_keys.id, api_keys.user_id, api_keys.name, api_keys.permissions, api_keys.expiry,
+         api_keys.created_at, api_keys.last_used_at,
+         users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.activated_at, users.suspended, users.version
+         FROM api_keys
+         INNER JOIN users ON users.id = api_keys.user_id
+         WHERE api_keys.hash = $1
+         AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	var key APIKey
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], time.Now()).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.Expiry,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &key, &user, nil
+}
+
+// Deletes a key of the given user.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	ctx, span := trace.Start(ctx, "APIKeyModel.Delete")
+	defer span.End()
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Records that a key has just been used. To keep writes down, the
+// timestamp is only moved forward once a minute.
+func (m APIKeyModel) Touch(ctx context.Context, id int64) error {
+	ctx, span := trace.Start(ctx, "APIKeyModel.Touch")
+	defer span.End()
+
+	query :=
+		`UPDATE api_keys SET last_used_at = $2
+         WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2 - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, time.Now())
+	return err
+}
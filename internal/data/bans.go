@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"sync"
+	"time"
+)
+
+// A client temporarily refused by its IP address.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Expiry    time.Time `json:"expiry"`
+	Manual    bool      `json:"manual"` // Added through the admin API
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Bans and the offences that may lead to them are kept in the database, so
+// that every instance of the API enforces the same bans.
+type BanModel struct {
+	DB      *sql.DB
+	Cache   *Cache
+	Strikes *BanStrikes
+}
+
+type strikeKey struct {
+	ip     string
+	reason string
+}
+
+// Offences of clients by reason, waiting to be written.
+type BanStrikes struct {
+	mu     sync.Mutex
+	counts map[strikeKey]int
+}
+
+func NewBanStrikes() *BanStrikes {
+	return &BanStrikes{counts: make(map[strikeKey]int)}
+}
+
+// Returns the ban of a client if there is one in effect.
+func (m BanModel) Get(ctx context.Context, ip string) (*Ban, error) {
+	ctx, span := trace.Start(ctx, "BanModel.Get")
+	defer span.End()
+
+	cached, generation, ok := m.Cache.getBan(ip)
+	if ok {
+		if cached == nil {
+			return nil, ErrRecordNotFound
+		}
+		return cached, nil
+	}
+
+	query := `SELECT ip, reason, expiry, manual, created_at FROM bans WHERE ip = $1 AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var ban Ban
+	err := m.DB.QueryRowContext(ctx, query, ip).Scan(&ban.IP, &ban.Reason, &ban.Expiry, &ban.Manual, &ban.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			m.Cache.putBan(ip, nil, generation)
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	m.Cache.putBan(ip, &ban, generation)
+	return &ban, nil
+}
+
+// Returns the bans in effect, sorted by expiry.
+func (m BanModel) GetAll(ctx context.Context) ([]*Ban, error) {
+	ctx, span := trace.Start(ctx, "BanModel.GetAll")
+	defer span.End()
+
+	query := `SELECT ip, reason, expiry, manual, created_at FROM bans WHERE expiry > NOW() ORDER BY expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []*Ban{}
+	for rows.Next() {
+		var ban Ban
+		err := rows.Scan(&ban.IP, &ban.Reason, &ban.Expiry, &ban.Manual, &ban.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, &ban)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// Bans a client, replacing any ban it already had.
+func (m BanModel) Insert(ctx context.Context, ban *Ban) error {
+	ctx, span := trace.Start(ctx, "BanModel.Insert")
+	defer span.End()
+
+	query :=
+		`INSERT INTO bans (ip, reason, expiry, manual, created_at) VALUES ($1, $2, $3, $4, $5)
+         ON CONFLICT (ip) DO UPDATE SET reason = EXCLUDED.reason, expiry = EXCLUDED.expiry,
+         manual = EXCLUDED.manual, created_at = EXCLUDED.created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ban.IP, ban.Reason, ban.Expiry, ban.Manual, ban.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidateBan(ctx, ban.IP)
+}
+
+// Lifts the ban of a client. Returns ErrRecordNotFound if there was none in effect.
+func (m BanModel) Delete(ctx context.Context, ip string) error {
+	ctx, span := trace.Start(ctx, "BanModel.Delete")
+	defer span.End()
+
+	query := `DELETE FROM bans WHERE ip = $1 AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, ip)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return m.Cache.invalidateBan(ctx, ip)
+}
+
+// Records an offence of a client in memory until the next FlushStrikes, so that
+// a failing request costs no write.
+func (m BanModel) Strike(ip, reason string) {
+	m.Strikes.mu.Lock()
+	defer m.Strikes.mu.Unlock()
+	m.Strikes.counts[strikeKey{ip: ip, reason: reason}]++
+}
+
+// Adds the offences recorded since the previous flush to those in the window,
+// all in one query, and bans the clients that reached the threshold of the
+// reason, if it has one. Returns the new bans.
+func (m BanModel) FlushStrikes(ctx context.Context, thresholds map[string]int, window, banDuration time.Duration) ([]*Ban, error) {
+	ctx, span := trace.Start(ctx, "BanModel.FlushStrikes")
+	defer span.End()
+
+	m.Strikes.mu.Lock()
+	counts := m.Strikes.counts
+	m.Strikes.counts = make(map[strikeKey]int)
+	m.Strikes.mu.Unlock()
+
+	if len(counts) == 0 {
+		return nil, nil
+	}
+	ips := make([]string, 0, len(counts))
+	reasons := make([]string, 0, len(counts))
+	strikes := make([]int64, 0, len(counts))
+	for key, count := range counts {
+		ips = append(ips, key.ip)
+		reasons = append(reasons, key.reason)
+		strikes = append(strikes, int64(count))
+	}
+
+	query :=
+		`INSERT INTO ban_strikes (ip, reason, count, window_start)
+         SELECT ip, reason, count, NOW() FROM unnest($1::text[], $2::text[], $3::integer[]) AS strikes(ip, reason, count)
+         ON CONFLICT (ip, reason) DO UPDATE SET
+         count = CASE WHEN ban_strikes.window_start < NOW() - make_interval(secs => $4) THEN EXCLUDED.count ELSE ban_strikes.count + EXCLUDED.count END,
+         window_start = CASE WHEN ban_strikes.window_start < NOW() - make_interval(secs => $4) THEN NOW() ELSE ban_strikes.window_start END
+         RETURNING ip, reason, count`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ips), pq.Array(reasons), pq.Array(strikes), window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	bans := []*Ban{}
+	for rows.Next() {
+		var ip, reason string
+		var count int
+		err := rows.Scan(&ip, &reason, &count)
+		if err != nil {
+			return nil, err
+		}
+		threshold := thresholds[reason]
+		if threshold > 0 && count >= threshold {
+			bans = append(bans, &Ban{IP: ip, Reason: reason, Expiry: now.Add(banDuration), CreatedAt: now})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The count starts over once a client is banned.
+	for _, ban := range bans {
+		_, err = m.DB.ExecContext(ctx, `DELETE FROM ban_strikes WHERE ip = $1 AND reason = $2`, ban.IP, ban.Reason)
+		if err != nil {
+			return nil, err
+		}
+		err = m.Insert(ctx, ban)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bans, nil
+}
+
+// Deletes expired bans, and offences outside of their window.
+func (m BanModel) DeleteExpired(ctx context.Context, window time.Duration) error {
+	ctx, span := trace.Start(ctx, "BanModel.DeleteExpired")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM bans WHERE expiry < NOW()`)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM ban_strikes WHERE window_start < NOW() - make_interval(secs => $1)`, window.Seconds())
+	return err
+}
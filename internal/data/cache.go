@@ -0,0 +1,303 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Postgres channel on which cache invalidations are announced to every instance.
+const CacheInvalidationChannel = "cache_invalidation"
+
+// Upper bound on the number of entries of each kind kept in the cache.
+const cacheMaxEntries = 10000
+
+type cachedUser struct {
+	user   User
+	expiry time.Time
+}
+
+type cachedPermissions struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+type cachedBan struct {
+	ban    *Ban // nil if the address isn't banned
+	expiry time.Time
+}
+
+// Cache keeps the users of authentication tokens, the permissions of users and
+// the bans of IP addresses for a short time, so that they aren't read from the
+// database on every request. Models drop the entries of a user whenever they
+// change their tokens, record or permissions, and those of an address whenever
+// they change its ban, and announce it to the other instances with NOTIFY.
+// A nil *Cache is valid and caches nothing.
+type Cache struct {
+	DB  *sql.DB
+	ttl time.Duration
+
+	mu          sync.Mutex
+	generation  uint64 // Incremented on every invalidation
+	users       map[string]cachedUser
+	permissions map[int64]cachedPermissions
+	bans        map[string]cachedBan
+
+	tokenHits, tokenMisses           int64
+	permissionHits, permissionMisses int64
+}
+
+func NewCache(db *sql.DB, ttl time.Duration) *Cache {
+	return &Cache{
+		DB:          db,
+		ttl:         ttl,
+		users:       make(map[string]cachedUser),
+		permissions: make(map[int64]cachedPermissions),
+		bans:        make(map[string]cachedBan),
+	}
+}
+
+// Returns the hit and miss counters of the cache.
+func (c *Cache) Stats() map[string]int64 {
+	if c == nil {
+		return nil
+	}
+	return map[string]int64{
+		"token_hits":        atomic.LoadInt64(&c.tokenHits),
+		"token_misses":      atomic.LoadInt64(&c.tokenMisses),
+		"permission_hits":   atomic.LoadInt64(&c.permissionHits),
+		"permission_misses": atomic.LoadInt64(&c.permissionMisses),
+	}
+}
+
+// Returns a copy of the cached user of an authentication token hash, and the
+// generation to pass to putUser after a miss.
+func (c *Cache) getUser(tokenHash []byte) (*User, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.users[string(tokenHash)]
+	if !ok || time.Now().After(entry.expiry) {
+		atomic.AddInt64(&c.tokenMisses, 1)
+		return nil, c.generation, false
+	}
+	atomic.AddInt64(&c.tokenHits, 1)
+	user := entry.user
+	return &user, c.generation, true
+}
+
+// Stores the user of an authentication token hash until the token expires or
+// the TTL runs out, unless something was invalidated since the generation was read.
+func (c *Cache) putUser(tokenHash []byte, user *User, tokenExpiry time.Time, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || !c.makeRoom(len(c.users)) {
+		return
+	}
+	expiry := time.Now().Add(c.ttl)
+	if tokenExpiry.Before(expiry) {
+		expiry = tokenExpiry
+	}
+	c.users[string(tokenHash)] = cachedUser{user: *user, expiry: expiry}
+}
+
+// Returns a copy of the cached permissions of a user, and the generation to
+// pass to putPermissions after a miss.
+func (c *Cache) getPermissions(userID int64) (Permissions, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.permissions[userID]
+	if !ok || time.Now().After(entry.expiry) {
+		atomic.AddInt64(&c.permissionMisses, 1)
+		return nil, c.generation, false
+	}
+	atomic.AddInt64(&c.permissionHits, 1)
+	return append(Permissions(nil), entry.permissions...), c.generation, true
+}
+
+func (c *Cache) putPermissions(userID int64, permissions Permissions, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || !c.makeRoom(len(c.permissions)) {
+		return
+	}
+	c.permissions[userID] = cachedPermissions{
+		permissions: append(Permissions(nil), permissions...),
+		expiry:      time.Now().Add(c.ttl),
+	}
+}
+
+// Returns the cached ban of an IP address, nil if it isn't banned, and the
+// generation to pass to putBan after a miss.
+func (c *Cache) getBan(ip string) (*Ban, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.bans[ip]
+	if !ok || time.Now().After(entry.expiry) {
+		return nil, c.generation, false
+	}
+	if entry.ban == nil {
+		return nil, c.generation, true
+	}
+	ban := *entry.ban
+	return &ban, c.generation, true
+}
+
+// Stores the ban of an IP address, or that it has none, until the ban ends or
+// the TTL runs out.
+func (c *Cache) putBan(ip string, ban *Ban, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || !c.makeRoom(len(c.bans)) {
+		return
+	}
+	expiry := time.Now().Add(c.ttl)
+	if ban != nil {
+		if ban.Expiry.Before(expiry) {
+			expiry = ban.Expiry
+		}
+		copied := *ban
+		ban = &copied
+	}
+	c.bans[ip] = cachedBan{ban: ban, expiry: expiry}
+}
+
+// Drops expired entries once the cache is full, and reports whether a new
+// entry fits. Must be called with the mutex held.
+func (c *Cache) makeRoom(size int) bool {
+	if size < cacheMaxEntries {
+		return true
+	}
+	now := time.Now()
+	for key, entry := range c.users {
+		if now.After(entry.expiry) {
+			delete(c.users, key)
+		}
+	}
+	for key, entry := range c.permissions {
+		if now.After(entry.expiry) {
+			delete(c.permissions, key)
+		}
+	}
+	for key, entry := range c.bans {
+		if now.After(entry.expiry) {
+			delete(c.bans, key)
+		}
+	}
+	return len(c.users) < cacheMaxEntries && len(c.permissions) < cacheMaxEntries && len(c.bans) < cacheMaxEntries
+}
+
+// Drops the cached tokens and permissions of a user, or of everyone for a zero userID.
+func (c *Cache) drop(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if userID == 0 {
+		c.users = make(map[string]cachedUser)
+		c.permissions = make(map[int64]cachedPermissions)
+		c.bans = make(map[string]cachedBan)
+		return
+	}
+	for key, entry := range c.users {
+		if entry.user.ID == userID {
+			delete(c.users, key)
+		}
+	}
+	delete(c.permissions, userID)
+}
+
+// Drops the entries of the given users here and on every other instance.
+// Models call it after changing the tokens, record or permissions of users.
+func (c *Cache) invalidate(ctx context.Context, userIDs ...int64) error {
+	if c == nil {
+		return nil
+	}
+	for _, userID := range userIDs {
+		c.drop(userID)
+		_, err := c.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, CacheInvalidationChannel, "user:"+strconv.FormatInt(userID, 10))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drops the cached ban of an IP address.
+func (c *Cache) dropBan(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.bans, ip)
+}
+
+// Drops the cached ban of an IP address here and on every other instance.
+// Models call it after banning an address or lifting its ban.
+func (c *Cache) invalidateBan(ctx context.Context, ip string) error {
+	if c == nil {
+		return nil
+	}
+	c.dropBan(ip)
+	_, err := c.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, CacheInvalidationChannel, "ban:"+ip)
+	return err
+}
+
+// Drops every entry here and on every other instance.
+func (c *Cache) invalidateAll(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.drop(0)
+	_, err := c.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, CacheInvalidationChannel, "all")
+	return err
+}
+
+// Applies an invalidation announced on CacheInvalidationChannel. Unknown
+// payloads drop everything, to be on the safe side.
+func (c *Cache) Apply(payload string) {
+	if c == nil {
+		return
+	}
+	if strings.HasPrefix(payload, "ban:") {
+		c.dropBan(strings.TrimPrefix(payload, "ban:"))
+		return
+	}
+	if strings.HasPrefix(payload, "user:") {
+		userID, err := strconv.ParseInt(strings.TrimPrefix(payload, "user:"), 10, 64)
+		if err == nil && userID > 0 {
+			c.drop(userID)
+			return
+		}
+	}
+	c.drop(0)
+}
+
+// Drops every entry of this instance only, e.g. after notifications may have been missed.
+func (c *Cache) Flush() {
+	if c == nil {
+		return
+	}
+	c.drop(0)
+}
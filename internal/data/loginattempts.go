@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"time"
+)
+
+// Failed logins of a user since the last successful one.
+type LoginAttempts struct {
+	UserID       int64      `json:"-"`
+	FailedCount  int        `json:"failed_count"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+// Reports whether the account is locked at the given time.
+func (a *LoginAttempts) Locked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// Returns the failed attempts of a user. Users without any get a zero count.
+func (m LoginAttemptModel) Get(ctx context.Context, userID int64) (*LoginAttempts, error) {
+	ctx, span := trace.Start(ctx, "LoginAttemptModel.Get")
+	defer span.End()
+
+	query := `SELECT user_id, failed_count, last_failed_at, locked_until FROM users_login_attempts WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var attempts LoginAttempts
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&attempts.UserID,
+		&attempts.FailedCount,
+		&attempts.LastFailedAt,
+		&attempts.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &LoginAttempts{UserID: userID}, nil
+		default:
+			return nil, err
+		}
+	}
+	return &attempts, nil
+}
+
+// Counts one more failed attempt and returns the updated record.
+func (m LoginAttemptModel) RecordFailure(ctx context.Context, userID int64) (*LoginAttempts, error) {
+	ctx, span := trace.Start(ctx, "LoginAttemptModel.RecordFailure")
+	defer span.End()
+
+	query :=
+		`INSERT INTO users_login_attempts (user_id, failed_count, last_failed_at) VALUES ($1, 1, $2)
+         ON CONFLICT (user_id) DO UPDATE SET failed_count = users_login_attempts.failed_count + 1, last_failed_at = $2
+         RETURNING user_id, failed_count, last_failed_at, locked_until`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var attempts LoginAttempts
+	err := m.DB.QueryRowContext(ctx, query, userID, time.Now()).Scan(
+		&attempts.UserID,
+		&attempts.FailedCount,
+		&attempts.LastFailedAt,
+		&attempts.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+// Locks the account until the given time.
+func (m LoginAttemptModel) Lock(ctx context.Context, userID int64, until time.Time) error {
+	ctx, span := trace.Start(ctx, "LoginAttemptModel.Lock")
+	defer span.End()
+
+	query := `UPDATE users_login_attempts SET locked_until = $2 WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, until)
+	return err
+}
+
+// Clears the failed attempts of a user, unlocking the account.
+func (m LoginAttemptModel) Reset(ctx context.Context, userID int64) error {
+	ctx, span := trace.Start(ctx, "LoginAttemptModel.Reset")
+	defer span.End()
+
+	query := `DELETE FROM users_login_attempts WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
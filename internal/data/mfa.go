@@ -0,0 +1,198 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"strings"
+	"time"
+)
+
+// Number of recovery codes generated when TOTP is enabled.
+const recoveryCodeCount = 10
+
+// TOTP enrollment of a user. It only protects logins once confirmed.
+type TOTP struct {
+	UserID    int64
+	Secret    string
+	Confirmed bool
+	LastStep  int64 // Time step of the last accepted code, to prevent replays
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// Returns new plaintext recovery codes.
+func NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:8] + "-" + code[8:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hash[:]
+}
+
+type MFAModel struct {
+	DB *sql.DB
+}
+
+// Starts a new, unconfirmed enrollment, replacing any previous unconfirmed one.
+func (m MFAModel) SetTOTP(ctx context.Context, userID int64, secret string) error {
+	ctx, span := trace.Start(ctx, "MFAModel.SetTOTP")
+	defer span.End()
+
+	query :=
+		`INSERT INTO users_totp (user_id, secret) VALUES ($1, $2)
+         ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = false, last_step = 0, created_at = NOW()
+         WHERE users_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+func (m MFAModel) GetTOTP(ctx context.Context, userID int64) (*TOTP, error) {
+	ctx, span := trace.Start(ctx, "MFAModel.GetTOTP")
+	defer span.End()
+
+	query := `SELECT user_id, secret, confirmed, last_step FROM users_totp WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var totp TOTP
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.UserID, &totp.Secret, &totp.Confirmed, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// Records that the code of a time step was used. Returns false if a code of
+// that or a later step was already used, which means the code is replayed.
+func (m MFAModel) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	ctx, span := trace.Start(ctx, "MFAModel.UseTOTPStep")
+	defer span.End()
+
+	query := `UPDATE users_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Confirms the enrollment and replaces the user's recovery codes.
+func (m MFAModel) ConfirmTOTP(ctx context.Context, userID int64, recoveryCodes []string) error {
+	ctx, span := trace.Start(ctx, "MFAModel.ConfirmTOTP")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users_totp SET confirmed = true WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO users_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Consumes a recovery code. Returns false if the user has no such code.
+func (m MFAModel) UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	ctx, span := trace.Start(ctx, "MFAModel.UseRecoveryCode")
+	defer span.End()
+
+	query := `DELETE FROM users_recovery_codes WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Disables TOTP for a user and removes the recovery codes.
+func (m MFAModel) DeleteTOTP(ctx context.Context, userID int64) error {
+	ctx, span := trace.Start(ctx, "MFAModel.DeleteTOTP")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -15,13 +15,30 @@ type Models struct {
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Roles       RoleModel
+	APIKeys     APIKeyModel
+	MFA         MFAModel
+	Logins      LoginAttemptModel
+	OAuth       OAuthModel
+	Bans        BanModel
+	Revocations RevocationModel
+	OIDCLogins  OIDCLoginModel
 }
 
-func NewModels(db *sql.DB) Models {
+// The cache may be nil, in which case nothing is cached.
+func NewModels(db *sql.DB, cache *Cache) Models {
 	return Models{
 		Musics:      MusicModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Users:       UserModel{DB: db, Cache: cache},
+		Tokens:      TokenModel{DB: db, Cache: cache, Usage: NewTokenUsage()},
+		Permissions: PermissionModel{DB: db, Cache: cache},
+		Roles:       RoleModel{DB: db, Cache: cache},
+		APIKeys:     APIKeyModel{DB: db},
+		MFA:         MFAModel{DB: db},
+		Logins:      LoginAttemptModel{DB: db},
+		OAuth:       OAuthModel{DB: db},
+		Bans:        BanModel{DB: db, Cache: cache, Strikes: NewBanStrikes()},
+		Revocations: RevocationModel{DB: db},
+		OIDCLogins:  OIDCLoginModel{DB: db},
 	}
 }
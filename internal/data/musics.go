@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
 	"time"
 )
@@ -36,20 +37,26 @@ func ValidateMusic(v *validator.Validator, music *Music) {
 
 }
 
-func (m MusicModel) Insert(music *Music) error {
+func (m MusicModel) Insert(ctx context.Context, music *Music) error {
+	ctx, span := trace.Start(ctx, "MusicModel.Insert")
+	defer span.End()
+
 	query := `
 INSERT INTO musics (title, year, author, link) 
 VALUES ($1, $2, $3, $4)
 RETURNING id, created_at, version`
 
 	args := []interface{}{music.Title, music.Year, music.Author, music.Link}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&music.ID, &music.CreatedAt, &music.Version)
 }
 
-func (m *MusicModel) Get(id int64) (*Music, error) {
+func (m *MusicModel) Get(ctx context.Context, id int64) (*Music, error) {
+	ctx, span := trace.Start(ctx, "MusicModel.Get")
+	defer span.End()
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -60,7 +67,7 @@ FROM musics
 WHERE id = $1`
 
 	var music Music
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
@@ -84,7 +91,10 @@ WHERE id = $1`
 	return &music, nil
 }
 
-func (m *MusicModel) Update(music *Music) error {
+func (m *MusicModel) Update(ctx context.Context, music *Music) error {
+	ctx, span := trace.Start(ctx, "MusicModel.Update")
+	defer span.End()
+
 	query := `
 UPDATE musics
 SET title = $1, year = $2, author = $3, link = $4,version = version + 1
@@ -99,7 +109,7 @@ RETURNING version`
 		music.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&music.Version)
@@ -114,14 +124,17 @@ RETURNING version`
 	return nil
 }
 
-func (m *MusicModel) Delete(id int64) error {
+func (m *MusicModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := trace.Start(ctx, "MusicModel.Delete")
+	defer span.End()
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `DELETE FROM musics WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	result, err := m.DB.ExecContext(ctx, query, id)
@@ -141,7 +154,10 @@ func (m *MusicModel) Delete(id int64) error {
 	return nil
 }
 
-func (m *MusicModel) GetAll(title, author string, filters Filters) ([]*Music, Metadata, error) {
+func (m *MusicModel) GetAll(ctx context.Context, title, author string, filters Filters) ([]*Music, Metadata, error) {
+	ctx, span := trace.Start(ctx, "MusicModel.GetAll")
+	defer span.End()
+
 	query := fmt.Sprintf(`
 SELECT count(*) OVER(), id, created_at, title, year, author, link, version
 FROM musics
@@ -150,7 +166,7 @@ AND (to_tsvector('simple', author) @@ plainto_tsquery('simple', $2) OR $2 = '')
 ORDER BY %s %s, id ASC
 LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	args := []interface{}{title, author, filters.limit(), filters.offset()}
@@ -0,0 +1,370 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"net/url"
+	"time"
+)
+
+// Third-party application allowed to act on behalf of users.
+type OAuthClient struct {
+	ID           string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"` // Only known when the client is registered
+	SecretHash   []byte      `json:"-"`                       // nil for public clients
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"` // Permission codes the client may ask for
+	UserID       int64       `json:"-"`      // Owner of the registration
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// Reports whether the client can keep a secret, as opposed to mobile and browser apps.
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != nil
+}
+
+// Compares the secret in constant time.
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	hash := sha256.Sum256([]byte(secret))
+	return c.Confidential() && subtle.ConstantTimeCompare(c.SecretHash, hash[:]) == 1
+}
+
+// Authorization code together with the grant it stands for.
+type OAuthCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string // S256 PKCE challenge
+	Expiry        time.Time
+}
+
+// Checks a PKCE code verifier against the challenge of the code.
+func (c *OAuthCode) VerifierMatches(verifier string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient, permissions Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must contain at least 1 uri")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 uris")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must be absolute https urls without fragment, or http on localhost")
+	}
+
+	v.Check(len(client.Scopes) > 0, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range client.Scopes {
+		v.Check(validator.In(scope, permissions...), "scopes", "must only contain existing permission codes")
+	}
+}
+
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"))
+}
+
+func ValidateCodeChallenge(v *validator.Validator, challenge, method string) {
+	v.Check(method == "S256", "code_challenge_method", "must be S256")
+	// Base64url of a SHA-256 hash without padding.
+	v.Check(len(challenge) == 43, "code_challenge", "must be 43 bytes long")
+}
+
+func ValidateCodeVerifier(v *validator.Validator, verifier string) {
+	v.Check(len(verifier) >= 43, "code_verifier", "must be at least 43 bytes long")
+	v.Check(len(verifier) <= 128, "code_verifier", "must not be more than 128 bytes long")
+}
+
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+// Registers a client, generating its id and, unless it is public, its secret.
+func (m OAuthModel) InsertClient(ctx context.Context, client *OAuthClient, public bool) error {
+	ctx, span := trace.Start(ctx, "OAuthModel.InsertClient")
+	defer span.End()
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	client.ID = hex.EncodeToString(randomBytes)
+
+	if !public {
+		randomBytes = make([]byte, 32)
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			return err
+		}
+		client.Secret = base64.RawURLEncoding.EncodeToString(randomBytes)
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	query :=
+		`INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, scopes, user_id) VALUES ($1, $2, $3, $4, $5, $6)
+         RETURNING created_at`
+	args := []interface{}{client.ID, client.SecretHash, client.Name, pq.Array(client.RedirectURIs), pq.Array(client.Scopes), client.UserID}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+func (m OAuthModel) GetClient(ctx context.Context, id string) (*OAuthClient, error) {
+	ctx, span := trace.Start(ctx, "OAuthModel.GetClient")
+	defer span.End()
+
+	query := `SELECT id, secret_hash, name, redirect_uris, scopes, user_id, created_at FROM oauth_clients WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var client OAuthClient
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&client.ID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array((*[]string)(&client.Scopes)),
+		&client.UserID,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &client, nil
+}
+
+// Returns the clients registered by a user.
+func (m OAuthModel) GetClientsForUser(ctx context.Context, userID int64) ([]*OAuthClient, error) {
+	ctx, span := trace.Start(ctx, "OAuthModel.GetClientsForUser")
+	defer span.End()
+
+	query :=
+		`SELECT id, secret_hash, name, redirect_uris, scopes, user_id, created_at FROM oauth_clients
+         WHERE user_id = $1
+         ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+		err := rows.Scan(
+			&client.ID,
+			&client.SecretHash,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			pq.Array((*[]string)(&client.Scopes)),
+			&client.UserID,
+			&client.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, &client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// Deletes a client of the given user. Its codes and tokens go with it.
+func (m OAuthModel) DeleteClient(ctx context.Context, id string, userID int64) error {
+	ctx, span := trace.Start(ctx, "OAuthModel.DeleteClient")
+	defer span.End()
+
+	query := `DELETE FROM oauth_clients WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Generates and stores a new authorization code.
+func (m OAuthModel) NewCode(ctx context.Context, code *OAuthCode, ttl time.Duration) error {
+	ctx, span := trace.Start(ctx, "OAuthModel.NewCode")
+	defer span.End()
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	code.Plaintext = base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(code.Plaintext))
+	code.Hash = hash[:]
+	code.Expiry = time.Now().Add(ttl)
+
+	query :=
+		`INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{code.Hash, code.ClientID, code.UserID, code.RedirectURI, pq.Array(code.Scopes), code.CodeChallenge, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Deletes an authorization code and returns it, so that it can only be used once.
+func (m OAuthModel) ConsumeCode(ctx context.Context, codePlaintext string) (*OAuthCode, error) {
+	ctx, span := trace.Start(ctx, "OAuthModel.ConsumeCode")
+	defer span.End()
+
+	codeHash := sha256.Sum256([]byte(codePlaintext))
+
+	query :=
+		`DELETE FROM oauth_codes WHERE hash = $1
+         RETURNING hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var code OAuthCode
+	err := m.DB.QueryRowContext(ctx, query, codeHash[:]).Scan(
+		&code.Hash,
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array((*[]string)(&code.Scopes)),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+	code.Plaintext = codePlaintext
+	return &code, nil
+}
+
+// Issues an access token for a client acting on behalf of a user within the granted scopes.
+func (m OAuthModel) NewAccessToken(ctx context.Context, userID int64, clientID string, scopes Permissions, ttl time.Duration) (*Token, error) {
+	ctx, span := trace.Start(ctx, "OAuthModel.NewAccessToken")
+	defer span.End()
+
+	token, err := generateToken(userID, ttl, ScopeOAuthAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	query :=
+		`INSERT INTO tokens (hash, user_id, expiry, scope, created_at, client_id, oauth_scopes) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.CreatedAt, clientID, pq.Array(scopes)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return token, err
+}
+
+// Returns the user and granted scopes of an unexpired access token.
+func (m OAuthModel) GetForAccessToken(ctx context.Context, tokenPlaintext string) (*User, Permissions, error) {
+	ctx, span := trace.Start(ctx, "OAuthModel.GetForAccessToken")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query :=
+		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.activated_at, users.suspended, users.version,
+         tokens.oauth_scopes
+         FROM users
+         INNER JOIN tokens
+         ON users.id = tokens.user_id
+         WHERE tokens.hash = $1
+         AND tokens.scope = $2
+         AND tokens.expiry > $3`
+
+	args := []interface{}{tokenHash[:], ScopeOAuthAccess, time.Now()}
+	var user User
+	var scopes Permissions
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
+		&user.Version,
+		pq.Array((*[]string)(&scopes)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &user, scopes, nil
+}
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"time"
+)
+
+// Secrets of a login in progress at the identity provider, keyed by its state
+// parameter, which only the hash of is stored.
+type OIDCLogin struct {
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   int64 // Set when a logged in user links the identity to their account
+	Expiry       time.Time
+}
+
+type OIDCLoginModel struct {
+	DB *sql.DB
+}
+
+func (m OIDCLoginModel) Insert(ctx context.Context, state string, login *OIDCLogin) error {
+	ctx, span := trace.Start(ctx, "OIDCLoginModel.Insert")
+	defer span.End()
+
+	stateHash := sha256.Sum256([]byte(state))
+
+	query :=
+		`INSERT INTO oidc_logins (state_hash, nonce, code_verifier, link_user_id, expiry)
+         VALUES ($1, $2, $3, NULLIF($4, 0), $5)`
+	args := []interface{}{stateHash[:], login.Nonce, login.CodeVerifier, login.LinkUserID, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Deletes the login with the given state and returns it, so that it can only
+// be completed once.
+func (m OIDCLoginModel) Consume(ctx context.Context, state string) (*OIDCLogin, error) {
+	ctx, span := trace.Start(ctx, "OIDCLoginModel.Consume")
+	defer span.End()
+
+	stateHash := sha256.Sum256([]byte(state))
+
+	query :=
+		`DELETE FROM oidc_logins WHERE state_hash = $1
+         RETURNING nonce, code_verifier, COALESCE(link_user_id, 0), expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var login OIDCLogin
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.LinkUserID, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+	return &login, nil
+}
+
+// Deletes logins that were abandoned.
+func (m OIDCLoginModel) DeleteExpired(ctx context.Context) error {
+	ctx, span := trace.Start(ctx, "OIDCLoginModel.DeleteExpired")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_logins WHERE expiry < NOW()`)
+	return err
+}
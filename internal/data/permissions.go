@@ -4,34 +4,98 @@ import (
 	"context"
 	"database/sql"
 	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"strings"
 	"time"
 )
 
 type Permissions []string
 
-// Check whether the Permissions slice contains a specific permission code.
+// Check whether the Permissions slice grants a specific permission code.
+// Besides exact codes, "*" grants everything and "musics:*" grants every
+// "musics:" code.
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if code == p[i] || p[i] == "*" {
+			return true
+		}
+		if strings.HasSuffix(p[i], ":*") && strings.HasPrefix(code, strings.TrimSuffix(p[i], "*")) {
 			return true
 		}
 	}
 	return false
 }
 
+// Returns the permission codes of p that are also granted by other.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	permissions := Permissions{}
+	for i := range p {
+		if other.Include(p[i]) {
+			permissions = append(permissions, p[i])
+		}
+	}
+	return permissions
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *Cache
 }
 
-// Returns all permission codes for a specific user.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Returns every permission code that exists.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	ctx, span := trace.Start(ctx, "PermissionModel.GetAll")
+	defer span.End()
+
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Returns all permission codes for a specific user, both granted directly and through roles.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := trace.Start(ctx, "PermissionModel.GetAllForUser")
+	defer span.End()
+
+	permissions, generation, ok := m.Cache.getPermissions(userID)
+	if ok {
+		return permissions, nil
+	}
+
 	query :=
 		`SELECT permissions.code FROM permissions
          INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-         INNER JOIN users ON users_permissions.user_id = users.id
-         WHERE users.id = $1`
+         WHERE users_permissions.user_id = $1
+         UNION
+         SELECT permissions.code FROM permissions
+         INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+         INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+         WHERE users_roles.user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -40,7 +104,6 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -54,16 +117,91 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	m.Cache.putPermissions(userID, permissions, generation)
+
 	return permissions, nil
 }
 
-// Add the provided permission codes for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
-	query := `INSERT INTO users_permissions SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+// Add the provided permission codes for a specific user. Codes the user already has are left alone.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := trace.Start(ctx, "PermissionModel.AddForUser")
+	defer span.End()
+
+	query := `INSERT INTO users_permissions SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+              ON CONFLICT DO NOTHING`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Remove the provided permission codes from a specific user. Permissions
+// granted through roles are not affected. Returns ErrRecordNotFound if the
+// user held none of them directly.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := trace.Start(ctx, "PermissionModel.RemoveForUser")
+	defer span.End()
+
+	query := `DELETE FROM users_permissions USING permissions
+              WHERE users_permissions.permission_id = permissions.id
+              AND users_permissions.user_id = $1 AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Returns the permission codes granted directly to a specific user, not through roles.
+func (m PermissionModel) GetDirectForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := trace.Start(ctx, "PermissionModel.GetDirectForUser")
+	defer span.End()
+
+	query :=
+		`SELECT permissions.code FROM permissions
+         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+         WHERE users_permissions.user_id = $1
+         ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
 }
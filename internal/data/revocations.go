@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"strconv"
+	"time"
+)
+
+// Postgres channel on which revocations of signed tokens are announced to
+// every instance, as "token:<id>:<expiry>" or "user:<id>:<revoked at>" with
+// Unix times.
+const RevocationChannel = "signed_token_revocations"
+
+// Signed tokens revoked before they expire.
+type Revocations struct {
+	Tokens map[string]time.Time // Token id -> expiry
+	Users  map[int64]time.Time  // User id -> tokens issued up to this time are revoked
+}
+
+// Signed tokens can't be deleted, so their revocations are recorded until
+// every token they cover has expired.
+type RevocationModel struct {
+	DB *sql.DB
+}
+
+// Revokes a single token.
+func (m RevocationModel) RevokeToken(ctx context.Context, id string, expiry time.Time) error {
+	ctx, span := trace.Start(ctx, "RevocationModel.RevokeToken")
+	defer span.End()
+
+	query := `INSERT INTO revoked_tokens (id, expiry) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, expiry)
+	if err != nil {
+		return err
+	}
+	return m.notify(ctx, "token:"+id+":"+strconv.FormatInt(expiry.Unix(), 10))
+}
+
+// Revokes every token issued to the user so far, and returns the time of the
+// revocation. It is kept until the given expiry, by when those tokens have expired.
+func (m RevocationModel) RevokeUser(ctx context.Context, userID int64, expiry time.Time) (time.Time, error) {
+	ctx, span := trace.Start(ctx, "RevocationModel.RevokeUser")
+	defer span.End()
+
+	query :=
+		`INSERT INTO revoked_users (user_id, revoked_at, expiry) VALUES ($1, NOW(), $2)
+         ON CONFLICT (user_id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at, expiry = EXCLUDED.expiry
+         RETURNING revoked_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var revokedAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, userID, expiry).Scan(&revokedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = m.notify(ctx, "user:"+strconv.FormatInt(userID, 10)+":"+strconv.FormatInt(revokedAt.Unix(), 10))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return revokedAt, nil
+}
+
+func (m RevocationModel) notify(ctx context.Context, payload string) error {
+	_, err := m.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, RevocationChannel, payload)
+	return err
+}
+
+// Returns the revocations in effect.
+func (m RevocationModel) GetAll(ctx context.Context) (*Revocations, error) {
+	ctx, span := trace.Start(ctx, "RevocationModel.GetAll")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	revocations := &Revocations{
+		Tokens: make(map[string]time.Time),
+		Users:  make(map[int64]time.Time),
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, expiry FROM revoked_tokens WHERE expiry > NOW()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var expiry time.Time
+		err := rows.Scan(&id, &expiry)
+		if err != nil {
+			return nil, err
+		}
+		revocations.Tokens[id] = expiry
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `SELECT user_id, revoked_at FROM revoked_users WHERE expiry > NOW()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int64
+		var revokedAt time.Time
+		err := rows.Scan(&userID, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		revocations.Users[userID] = revokedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// Deletes the revocations of tokens that have expired anyway.
+func (m RevocationModel) DeleteExpired(ctx context.Context) error {
+	ctx, span := trace.Start(ctx, "RevocationModel.DeleteExpired")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expiry < NOW()`)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM revoked_users WHERE expiry < NOW()`)
+	return err
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
+	"time"
+)
+
+// Default roles created by the roles migration.
+const (
+	RoleListener = "listener"
+	RoleEditor   = "editor"
+	RoleAdmin    = "admin"
+)
+
+// A Role is a named bundle of permission codes.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *Cache
+}
+
+// Returns every role together with its permission codes.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	ctx, span := trace.Start(ctx, "RoleModel.GetAll")
+	defer span.End()
+
+	query := `
+        SELECT roles.id, roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        GROUP BY roles.id
+        ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Name, pq.Array((*[]string)(&role.Permissions)))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Returns the names of the roles assigned to a specific user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := trace.Start(ctx, "RoleModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+        SELECT roles.name FROM roles
+        INNER JOIN users_roles ON users_roles.role_id = roles.id
+        WHERE users_roles.user_id = $1
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Assign the provided roles to a specific user. Roles the user already has are left alone.
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, names ...string) error {
+	ctx, span := trace.Start(ctx, "RoleModel.AddForUser")
+	defer span.End()
+
+	query := `
+        INSERT INTO users_roles
+        SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Remove the provided roles from a specific user. Returns ErrRecordNotFound
+// if the user had none of them.
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int64, names ...string) error {
+	ctx, span := trace.Start(ctx, "RoleModel.RemoveForUser")
+	defer span.End()
+
+	query := `
+        DELETE FROM users_roles
+        USING roles
+        WHERE users_roles.role_id = roles.id AND users_roles.user_id = $1 AND roles.name = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
@@ -1,33 +1,56 @@
 package data
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
+	"sync"
 	"time"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFA            = "mfa"
+	ScopeOAuthAccess    = "oauth-access"
 )
 
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext  string     `json:"token"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt *time.Time `json:"-"` // nil until the token is first used
+	IP         string     `json:"-"` // Client which requested the token
+	UserAgent  string     `json:"-"`
+	Family     []byte     `json:"-"` // Shared by all tokens descending from one login
+	RotatedAt  *time.Time `json:"-"` // Set once a refresh token has been exchanged
+}
+
+// Reports whether the token was generated from the given plaintext.
+func (t *Token) MatchesPlaintext(tokenPlaintext string) bool {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return bytes.Equal(t.Hash, hash[:])
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+		CreatedAt: time.Now(),
 	}
 
 	randomBytes := make([]byte, 16)
@@ -43,42 +66,361 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// Returns a new random identifier for a family of tokens.
+func NewTokenFamily() ([]byte, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+	return family, nil
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *Cache
+	Usage *TokenUsage
+}
+
+// Times tokens were last used, by token hash, waiting to be written.
+type TokenUsage struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewTokenUsage() *TokenUsage {
+	return &TokenUsage{used: make(map[string]time.Time)}
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.New")
+	defer span.End()
+
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+// Same as New, but also records the token family (may be nil) and the client the token was issued to.
+func (m TokenModel) NewForClient(ctx context.Context, userID int64, ttl time.Duration, scope string, family []byte, ip, userAgent string) (*Token, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.NewForClient")
+	defer span.End()
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := trace.Start(ctx, "TokenModel.Insert")
+	defer span.End()
+
 	query :=
-		`INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+		`INSERT INTO tokens (hash, user_id, expiry, scope, created_at, ip, user_agent, family) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.CreatedAt, token.IP, token.UserAgent, token.Family}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := trace.Start(ctx, "TokenModel.DeleteAllForUser")
+	defer span.End()
+
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Deletes the authentication and refresh tokens of the user, except those of
+// the session the given authentication token belongs to.
+func (m TokenModel) DeleteOtherSessions(ctx context.Context, userID int64, tokenPlaintext string) error {
+	ctx, span := trace.Start(ctx, "TokenModel.DeleteOtherSessions")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query :=
+		`DELETE FROM tokens
+         WHERE user_id = $1 AND scope IN ($3, $4) AND hash <> $2
+         AND (family IS NULL OR family <> COALESCE((SELECT family FROM tokens WHERE scope = $3 AND hash = $2), ''::bytea))`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, tokenHash[:], ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Deletes the tokens of the user in any of the given scopes, announcing the
+// change to other instances only once.
+func (m TokenModel) DeleteAllForUserInScopes(ctx context.Context, userID int64, scopes ...string) error {
+	ctx, span := trace.Start(ctx, "TokenModel.DeleteAllForUserInScopes")
+	defer span.End()
+
+	query := `DELETE FROM tokens WHERE user_id = $1 AND scope = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(scopes))
+	if err != nil {
+		return err
+	}
+	return m.Cache.invalidate(ctx, userID)
+}
+
+// Reports whether a token of the given scope was issued to the user after the provided time.
+func (m TokenModel) ExistsSinceForUser(ctx context.Context, scope string, userID int64, since time.Time) (bool, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.ExistsSinceForUser")
+	defer span.End()
+
+	query := `SELECT EXISTS(SELECT 1 FROM tokens WHERE scope = $1 AND user_id = $2 AND created_at > $3)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, scope, userID, since).Scan(&exists)
+	return exists, err
+}
+
+// Returns all unexpired tokens of the given scope for a user, newest first.
+func (m TokenModel) GetAllForUser(ctx context.Context, scope string, userID int64) ([]*Token, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.GetAllForUser")
+	defer span.End()
+
+	query :=
+		`SELECT hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent FROM tokens
+         WHERE scope = $1 AND user_id = $2 AND expiry > $3
+         ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(
+			&token.Hash,
+			&token.UserID,
+			&token.Expiry,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.IP,
+			&token.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Deletes the token with the given scope and plaintext, along with
+// every other token of its family.
+func (m TokenModel) DeleteWithFamily(ctx context.Context, scope, tokenPlaintext string) error {
+	ctx, span := trace.Start(ctx, "TokenModel.DeleteWithFamily")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query :=
+		`DELETE FROM tokens
+         WHERE (scope = $1 AND hash = $2)
+         OR family = (SELECT family FROM tokens WHERE scope = $1 AND hash = $2)
+         RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.deleteReturningUsers(ctx, query, scope, tokenHash[:])
+}
+
+// Deletes all tokens of a family, whatever their scope.
+func (m TokenModel) DeleteFamily(ctx context.Context, family []byte) error {
+	ctx, span := trace.Start(ctx, "TokenModel.DeleteFamily")
+	defer span.End()
+
+	query := `DELETE FROM tokens WHERE family = $1 RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.deleteReturningUsers(ctx, query, family)
+}
+
+// Runs a DELETE query returning the user_id of the deleted tokens, and
+// invalidates the cached users of those tokens.
+func (m TokenModel) deleteReturningUsers(ctx context.Context, query string, args ...interface{}) error {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seen := make(map[int64]bool)
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		err := rows.Scan(&userID)
+		if err != nil {
+			return err
+		}
+		if !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return m.Cache.invalidate(ctx, userIDs...)
+}
+
+// Returns the unexpired token with the given scope and plaintext, even if it was already rotated.
+func (m TokenModel) GetByPlaintext(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.GetByPlaintext")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query :=
+		`SELECT hash, user_id, expiry, scope, created_at, last_used_at, ip, user_agent, family, rotated_at FROM tokens
+         WHERE scope = $1 AND hash = $2 AND expiry > $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var token Token
+	err := m.DB.QueryRowContext(ctx, query, scope, tokenHash[:], time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.IP,
+		&token.UserAgent,
+		&token.Family,
+		&token.RotatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	token.Plaintext = tokenPlaintext
+	return &token, nil
+}
+
+// Marks a token as rotated. Returns false if it had already been rotated,
+// which means the token is being reused.
+func (m TokenModel) Rotate(ctx context.Context, token *Token) (bool, error) {
+	ctx, span := trace.Start(ctx, "TokenModel.Rotate")
+	defer span.End()
+
+	query := `UPDATE tokens SET rotated_at = $2 WHERE hash = $1 AND rotated_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, token.Hash, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Records that a token has just been used. The time is kept in memory until
+// the next FlushUsage, so that authenticating a request costs no write.
+func (m TokenModel) Touch(tokenPlaintext string) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.Usage.mu.Lock()
+	defer m.Usage.mu.Unlock()
+	m.Usage.used[string(tokenHash[:])] = time.Now()
+}
+
+// Writes the times tokens were last used since the previous flush, all in one query.
+func (m TokenModel) FlushUsage(ctx context.Context) error {
+	ctx, span := trace.Start(ctx, "TokenModel.FlushUsage")
+	defer span.End()
+
+	m.Usage.mu.Lock()
+	used := m.Usage.used
+	m.Usage.used = make(map[string]time.Time)
+	m.Usage.mu.Unlock()
+
+	if len(used) == 0 {
+		return nil
+	}
+	hashes := make([][]byte, 0, len(used))
+	times := make([]int64, 0, len(used))
+	for hash, usedAt := range used {
+		hashes = append(hashes, []byte(hash))
+		times = append(times, usedAt.Unix())
+	}
+
+	query :=
+		`UPDATE tokens SET last_used_at = to_timestamp(usage.used_at)
+         FROM unnest($1::bytea[], $2::bigint[]) AS usage(hash, used_at)
+         WHERE tokens.hash = usage.hash
+         AND (tokens.last_used_at IS NULL OR tokens.last_used_at < to_timestamp(usage.used_at))`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(hashes), pq.Array(times))
 	return err
 }
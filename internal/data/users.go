@@ -5,8 +5,12 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/ol-ilyassov/spa_final/internal/trace"
 	"github.com/ol-ilyassov/spa_final/internal/validator"
 	"golang.org/x/crypto/bcrypt"
+	"sync"
 	"time"
 )
 
@@ -23,7 +27,10 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"` // !
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"` // !
+	// When the account was first activated, kept if an administrator deactivates it.
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+	Suspended   bool       `json:"suspended"`
+	Version     int        `json:"-"` // !
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -31,6 +38,12 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// Reports whether an administrator deactivated the account, which the owner
+// can't activate again.
+func (u *User) Deactivated() bool {
+	return !u.Activated && u.ActivatedAt != nil
+}
+
 type password struct {
 	plaintext *string // distinguish between not being present versus empty string
 	hash      []byte
@@ -61,6 +74,21 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// Hash compared against when there is no user to check a password for.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Takes as long as checking a real password, so that response times
+// don't reveal whether an account exists.
+func SimulatePasswordCheck(plaintextPassword string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), 12)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(plaintextPassword))
+}
+
 // --------------------------------------------------------------------
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -92,17 +120,22 @@ func ValidateUser(v *validator.Validator, user *User) {
 // --------------------------------------------------------------------
 
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *Cache
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := trace.Start(ctx, "UserModel.Insert")
+	defer span.End()
+
 	query :=
-		`INSERT INTO users (name, email, password_hash, activated) VALUES ($1, $2, $3, $4) RETURNING id, created_at, version`
+		`INSERT INTO users (name, email, password_hash, activated, activated_at)
+         VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END) RETURNING id, created_at, activated_at, version`
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.ActivatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -114,12 +147,108 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	ctx, span := trace.Start(ctx, "UserModel.Get")
+	defer span.End()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query :=
+		`SELECT id, created_at, name, email, password_hash, activated, activated_at, suspended, version FROM users WHERE id = $1`
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Returns a page of users whose name and email contain the provided strings.
+// Empty strings match every user.
+func (m UserModel) GetAll(ctx context.Context, name, email string, filters Filters) ([]*User, Metadata, error) {
+	ctx, span := trace.Start(ctx, "UserModel.GetAll")
+	defer span.End()
+
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, email, activated, activated_at, suspended, version
+FROM users
+WHERE (strpos(lower(name), lower($1)) > 0 OR $1 = '')
+AND (strpos(lower(email), lower($2)) > 0 OR $2 = '')
+ORDER BY %s %s, id ASC
+LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{name, email, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.ActivatedAt,
+			&user.Suspended,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := trace.Start(ctx, "UserModel.GetByEmail")
+	defer span.End()
+
 	query :=
-		`SELECT id, created_at, name, email, password_hash, activated, version FROM users WHERE email = $1`
+		`SELECT id, created_at, name, email, password_hash, activated, activated_at, suspended, version FROM users WHERE email = $1`
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -129,6 +258,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
 		&user.Version,
 	)
 	if err != nil {
@@ -144,23 +275,28 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 // Version - race
 // Uniqueness - user_email_key
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := trace.Start(ctx, "UserModel.Update")
+	defer span.End()
+
 	query :=
-		`UPDATE users SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-         WHERE id = $5 AND version = $6 RETURNING version`
+		`UPDATE users SET name = $1, email = $2, password_hash = $3, activated = $4, suspended = $5, version = version + 1,
+         activated_at = COALESCE(activated_at, CASE WHEN $4 THEN NOW() END)
+         WHERE id = $6 AND version = $7 RETURNING activated_at, version`
 	args := []interface{}{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Suspended,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ActivatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -171,14 +307,57 @@ func (m UserModel) Update(user *User) error {
 			return err
 		}
 	}
-	return nil
+	// Cached users of the account's tokens are now out of date.
+	return m.Cache.invalidate(ctx, user.ID)
+}
+
+// Version - race
+func (m UserModel) Delete(ctx context.Context, user *User) error {
+	ctx, span := trace.Start(ctx, "UserModel.Delete")
+	defer span.End()
+
+	query := `DELETE FROM users WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, user.ID, user.Version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return m.Cache.invalidate(ctx, user.ID)
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// Authentication tokens are looked up on every request, so their users are cached.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := trace.Start(ctx, "UserModel.GetForToken")
+	defer span.End()
+
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	cached := m.Cache != nil && tokenScope == ScopeAuthentication
+	var generation uint64
+	if cached {
+		var user *User
+		var ok bool
+		user, generation, ok = m.Cache.getUser(tokenHash[:])
+		if ok {
+			return user, nil
+		}
+	}
+
 	query :=
-		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.activated_at, users.suspended, users.version, tokens.expiry
          FROM users 
          INNER JOIN tokens
          ON users.id = tokens.user_id
@@ -188,8 +367,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
+	var expiry time.Time
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -199,7 +379,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
 		&user.Version,
+		&expiry,
 	)
 	if err != nil {
 		switch {
@@ -210,5 +393,184 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 
+	if cached {
+		m.Cache.putUser(tokenHash[:], &user, expiry, generation)
+	}
+
 	return &user, nil
 }
+
+// Deletes users who never activated their account and were created before the
+// provided time, and returns how many were removed. Their tokens and
+// permissions are removed with them by ON DELETE CASCADE.
+func (m UserModel) DeleteUnactivatedBefore(ctx context.Context, createdBefore time.Time) (int64, error) {
+	ctx, span := trace.Start(ctx, "UserModel.DeleteUnactivatedBefore")
+	defer span.End()
+
+	query := `DELETE FROM users WHERE activated_at IS NULL AND created_at < $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+	return deleted, m.Cache.invalidateAll(ctx)
+}
+
+// Stores the email address a user wants to change to, replacing any previous one.
+func (m UserModel) SetPendingEmail(ctx context.Context, userID int64, email string) error {
+	ctx, span := trace.Start(ctx, "UserModel.SetPendingEmail")
+	defer span.End()
+
+	query :=
+		`INSERT INTO users_pending_emails (user_id, email) VALUES ($1, $2)
+         ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, created_at = NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, email)
+	return err
+}
+
+// Returns the email address a user wants to change to.
+func (m UserModel) GetPendingEmail(ctx context.Context, userID int64) (string, error) {
+	ctx, span := trace.Start(ctx, "UserModel.GetPendingEmail")
+	defer span.End()
+
+	query := `SELECT email FROM users_pending_emails WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var email string
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return email, nil
+}
+
+func (m UserModel) DeletePendingEmail(ctx context.Context, userID int64) error {
+	ctx, span := trace.Start(ctx, "UserModel.DeletePendingEmail")
+	defer span.End()
+
+	query := `DELETE FROM users_pending_emails WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Returns the user linked to an account at an external identity provider.
+func (m UserModel) GetForIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	ctx, span := trace.Start(ctx, "UserModel.GetForIdentity")
+	defer span.End()
+
+	query :=
+		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.activated_at, users.suspended, users.version
+         FROM users
+         INNER JOIN users_identities
+         ON users.id = users_identities.user_id
+         WHERE users_identities.issuer = $1
+         AND users_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.ActivatedAt,
+		&user.Suspended,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Links a user to an account at an external identity provider.
+func (m UserModel) AddIdentity(ctx context.Context, userID int64, issuer, subject string) error {
+	ctx, span := trace.Start(ctx, "UserModel.AddIdentity")
+	defer span.End()
+
+	query :=
+		`INSERT INTO users_identities (issuer, subject, user_id) VALUES ($1, $2, $3)
+         ON CONFLICT (issuer, subject) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	return err
+}
+
+// Inserts a user who logs in through an identity provider, with the given
+// roles and linked to the identity, all at once.
+func (m UserModel) InsertWithIdentity(ctx context.Context, user *User, issuer, subject string, roles ...string) error {
+	ctx, span := trace.Start(ctx, "UserModel.InsertWithIdentity")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query :=
+		`INSERT INTO users (name, email, password_hash, activated, activated_at)
+         VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END) RETURNING id, created_at, activated_at, version`
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.ActivatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO users_roles SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)`, user.ID, pq.Array(roles))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO users_identities (issuer, subject, user_id) VALUES ($1, $2, $3)`, issuer, subject, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,26 +29,47 @@ func (l Level) String() string {
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// Returns the level with the given name, such as "info", in any case.
+func ParseLevel(name string) (Level, error) {
+	for l := LevelInfo; l <= LevelOff; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
 // Custom Logger that holds output destination,
 // minimum severity level, and mutex to coordinate the writes.
 type Logger struct {
 	out      io.Writer
-	minLevel Level
+	minLevel int32 // Level, accessed atomically so that it can change at any time
 	mu       sync.Mutex
 }
 
 func New(out io.Writer, minLevel Level) *Logger {
 	return &Logger{
 		out:      out,
-		minLevel: minLevel,
+		minLevel: int32(minLevel),
 	}
 }
 
+// Changes the minimum severity level of entries written from now on.
+func (l *Logger) SetLevel(minLevel Level) {
+	atomic.StoreInt32(&l.minLevel, int32(minLevel))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.minLevel))
+}
+
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
@@ -59,7 +83,7 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
 	// Return with no further action if severity level below of minimum.
-	if level < l.minLevel {
+	if level < l.Level() {
 		return 0, nil
 	}
 	aux := struct {
@@ -0,0 +1,144 @@
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrExpiredToken = errors.New("expired token")
+	ErrNoKeys       = errors.New("at least one signing key is required")
+)
+
+// Secret used to sign and verify tokens, identified by the "kid" header.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Claims defined by RFC 7519 that are used by this package.
+// Embed it in a struct to add custom claims.
+type RegisteredClaims struct {
+	ID        string `json:"jti,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// Returns an error if the claims are not valid at the given time.
+func (c RegisteredClaims) Valid(now time.Time) error {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Signs and verifies HS256 JSON Web Tokens. Tokens are always signed with the
+// first key, while any of the keys is accepted on verification, so keys can
+// be rotated by putting a new one in front and dropping the old one once the
+// tokens signed with it have expired.
+type Signer struct {
+	current Key
+	keys    map[string][]byte
+}
+
+func NewSigner(keys ...Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	s := &Signer{
+		current: keys[0],
+		keys:    make(map[string][]byte, len(keys)),
+	}
+	for _, key := range keys {
+		s.keys[key.ID] = key.Secret
+	}
+	return s, nil
+}
+
+// Returns a signed token carrying the claims.
+func (s *Signer) Sign(claims interface{}) (string, error) {
+	h, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: s.current.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	return unsigned + "." + encoding.EncodeToString(sign(s.current.Secret, unsigned)), nil
+}
+
+// Checks the signature of the token and decodes its claims into dst. If dst
+// has a Valid(time.Time) error method, the claims are validated as well.
+func (s *Signer) Verify(token string, dst interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	h, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var hdr header
+	if err = json.Unmarshal(h, &hdr); err != nil || hdr.Algorithm != "HS256" {
+		return ErrInvalidToken
+	}
+
+	secret, ok := s.keys[hdr.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	// Compare in constant time to not leak information about the expected signature.
+	if !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return ErrInvalidToken
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(payload, dst); err != nil {
+		return ErrInvalidToken
+	}
+
+	if v, ok := dst.(interface{ Valid(time.Time) error }); ok {
+		return v.Valid(time.Now())
+	}
+	return nil
+}
+
+// Reports whether the string has the shape of a JWT, as opposed to an opaque token.
+func LooksLikeToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func sign(secret []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
@@ -2,9 +2,14 @@ package mailer
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"embed"
 	"github.com/go-mail/mail/v2"
 	"html/template"
+	"net"
+	"net/smtp"
+	"strconv"
 	"time"
 )
 
@@ -61,3 +66,32 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	}
 	return nil
 }
+
+// Checks that the SMTP server is reachable and greets clients, without
+// authenticating or sending anything.
+func (m Mailer) Ping(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(m.dialer.Host, strconv.Itoa(m.dialer.Port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Servers on the SMTPS port only greet clients after the TLS handshake.
+	if m.dialer.SSL {
+		config := m.dialer.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: m.dialer.Host}
+		}
+		conn = tls.Client(conn, config)
+	}
+
+	// The client reads the greeting of the server when it is created.
+	client, err := smtp.NewClient(conn, m.dialer.Host)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
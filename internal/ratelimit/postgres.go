@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Postgres keeps the state of every key in the rate_limits table, so that
+// all instances of the API share the same limits. Time is taken from the
+// database server, which keeps instances with skewed clocks consistent.
+type Postgres struct {
+	DB *sql.DB
+}
+
+// Returns a limiter backed by the database. Keys that are back to a full
+// burst are deleted every minute.
+func NewPostgres(db *sql.DB) *Postgres {
+	p := &Postgres{DB: db}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			p.DB.ExecContext(ctx, `DELETE FROM rate_limits WHERE tat < now()`)
+			cancel()
+		}
+	}()
+
+	return p
+}
+
+// Counts a request for the key against the policy.
+func (l *Postgres) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// Create the key if needed, and lock it until the transaction ends.
+	query := `
+        INSERT INTO rate_limits (key, tat) VALUES ($1, now())
+        ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+        RETURNING tat, now()`
+
+	var tat, now time.Time
+	err = tx.QueryRowContext(ctx, query, key).Scan(&tat, &now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	newTAT, result := gcra(tat, now, p)
+	if result.Allowed {
+		_, err = tx.ExecContext(ctx, `UPDATE rate_limits SET tat = $2 WHERE key = $1`, key, newTAT)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+func (l *Postgres) Peek(ctx context.Context, key string, p Policy) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// Unknown keys are at a full burst.
+	query := `SELECT COALESCE((SELECT tat FROM rate_limits WHERE key = $1), now()), now()`
+
+	var tat, now time.Time
+	err := l.DB.QueryRowContext(ctx, query, key).Scan(&tat, &now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	_, result := gcra(tat, now, p)
+	return result, nil
+}
@@ -0,0 +1,108 @@
+// Package ratelimit implements request rate limiting with the generic cell
+// rate algorithm (GCRA), which keeps a single timestamp per key and tells
+// exactly how many requests remain and when the next one is allowed.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Policy allows Rate requests per second on average, and bursts of up to Burst requests.
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+// Scales both the rate and the burst of the policy.
+func (p Policy) Multiply(factor float64) Policy {
+	return Policy{Rate: p.Rate * factor, Burst: int(float64(p.Burst) * factor)}
+}
+
+// Time between two requests at the policy's rate.
+func (p Policy) interval() time.Duration {
+	return time.Duration(float64(time.Second) / p.Rate)
+}
+
+// Result is the outcome of a request against a policy.
+type Result struct {
+	Allowed    bool
+	Limit      int           // Burst of the policy
+	Remaining  int           // Requests that would be allowed right now
+	RetryAfter time.Duration // Wait before the next request is allowed, if this one wasn't
+}
+
+// Applies a request arriving at now to the theoretical arrival time (TAT) of
+// a key, returning the new TAT and the result. The TAT is the time at which
+// the key would be back to a full burst.
+func gcra(tat, now time.Time, p Policy) (time.Time, Result) {
+	interval := p.interval()
+	tolerance := interval * time.Duration(p.Burst)
+
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-tolerance)
+
+	if now.Before(allowAt) {
+		return tat, Result{Limit: p.Burst, RetryAfter: allowAt.Sub(now)}
+	}
+	return newTAT, Result{Allowed: true, Limit: p.Burst, Remaining: int(now.Sub(allowAt) / interval)}
+}
+
+// Limiter counts requests against policies. Implementations differ in where
+// the state of the keys is kept.
+type Limiter interface {
+	Allow(ctx context.Context, key string, p Policy) (Result, error)
+	// Returns the result a request for the key would get, without counting it.
+	Peek(ctx context.Context, key string, p Policy) (Result, error)
+}
+
+// Memory keeps the state of every key in the memory of this process, so
+// every instance of the API enforces the limits separately.
+type Memory struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+}
+
+// Returns an in-memory limiter. Keys that are back to a full burst are
+// forgotten every minute, which doesn't change their outcome.
+func NewMemory() *Memory {
+	m := &Memory{tats: make(map[string]time.Time)}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			now := time.Now()
+			m.mu.Lock()
+			for key, tat := range m.tats {
+				if tat.Before(now) {
+					delete(m.tats, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}()
+
+	return m
+}
+
+// Counts a request for the key against the policy.
+func (m *Memory) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tat, result := gcra(m.tats[key], time.Now(), p)
+	m.tats[key] = tat
+	return result, nil
+}
+
+func (m *Memory) Peek(ctx context.Context, key string, p Policy) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, result := gcra(m.tats[key], time.Now(), p)
+	return result, nil
+}
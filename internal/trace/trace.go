@@ -0,0 +1,52 @@
+// Package trace starts OpenTelemetry spans for the work of the API, such as
+// database queries, under the spans of the requests they serve.
+//
+// Spans are only started within a trace, so code called with a context that
+// isn't traced doesn't record anything.
+package trace
+
+import (
+	"context"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Name under which the spans of the API are recorded.
+const InstrumentationName = "github.com/ol-ilyassov/spa_final"
+
+// Starts a span as a child of the span in the context. Nothing is recorded
+// if the context isn't traced.
+func Start(ctx context.Context, name string) (context.Context, oteltrace.Span) {
+	if !oteltrace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, oteltrace.SpanFromContext(ctx)
+	}
+	return otel.Tracer(InstrumentationName).Start(ctx, name)
+}
+
+// Records the error on the span and marks it as failed, if err isn't nil.
+func RecordError(span oteltrace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Returns a context that isn't canceled with the given one, but carries its
+// span, for work that outlives a request.
+func Detach(ctx context.Context) context.Context {
+	return oteltrace.ContextWithSpan(context.Background(), oteltrace.SpanFromContext(ctx))
+}
+
+// Wraps an HTTP transport so that outgoing requests get a client span and a
+// traceparent header, continuing the trace in the request context. The span
+// ends once the response body is read or closed. A nil base stands for
+// http.DefaultTransport.
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithFilter(func(r *http.Request) bool {
+		return oteltrace.SpanContextFromContext(r.Context()).IsValid()
+	}))
+}
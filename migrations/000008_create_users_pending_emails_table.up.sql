@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS users_pending_emails (
+user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+email citext NOT NULL,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
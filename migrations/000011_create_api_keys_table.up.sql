@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+id bigserial PRIMARY KEY,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+name text NOT NULL,
+hash bytea UNIQUE NOT NULL,
+permissions text[] NOT NULL,
+expiry timestamp(0) with time zone,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+last_used_at timestamp(0) with time zone,
+UNIQUE (user_id, name)
+);
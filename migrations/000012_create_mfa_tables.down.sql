@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS users_recovery_codes;
+DROP TABLE IF EXISTS users_totp;
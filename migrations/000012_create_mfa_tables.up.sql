@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS users_totp (
+user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+secret text NOT NULL,
+confirmed bool NOT NULL DEFAULT false,
+last_step bigint NOT NULL DEFAULT 0,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS users_recovery_codes (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+hash bytea NOT NULL,
+PRIMARY KEY (user_id, hash)
+);
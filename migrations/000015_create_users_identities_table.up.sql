@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users_identities (
+issuer text NOT NULL,
+subject text NOT NULL,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+PRIMARY KEY (issuer, subject)
+);
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS roles (
+id bigserial PRIMARY KEY,
+name text UNIQUE NOT NULL
+);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+PRIMARY KEY (role_id, permission_id)
+);
+CREATE TABLE IF NOT EXISTS users_roles (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+PRIMARY KEY (user_id, role_id)
+);
+-- Add the music and wildcard permissions the roles are built from.
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('musics:read'), ('musics:write'), ('musics:*'), ('*')) AS codes (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = codes.code);
+-- Add the default roles.
+INSERT INTO roles (name)
+VALUES
+('listener'),
+('editor'),
+('admin');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.name = 'listener' AND permissions.code = 'musics:read')
+OR (roles.name = 'editor' AND permissions.code = 'musics:*')
+OR (roles.name = 'admin' AND permissions.code = '*');
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('users:read', 'users:write');
+ALTER TABLE users DROP COLUMN IF EXISTS suspended;
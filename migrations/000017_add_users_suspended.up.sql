@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended bool NOT NULL DEFAULT false;
+-- Permissions for the administration endpoints.
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('users:read'), ('users:write')) AS codes (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = codes.code);
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+UPDATE users SET activated_at = created_at WHERE activated;
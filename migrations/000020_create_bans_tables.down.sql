@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ban_strikes;
+DROP TABLE IF EXISTS bans;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS bans (
+ip text PRIMARY KEY,
+reason text NOT NULL,
+expiry timestamp(0) with time zone NOT NULL,
+manual bool NOT NULL DEFAULT false,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE UNLOGGED TABLE IF NOT EXISTS ban_strikes (
+ip text NOT NULL,
+reason text NOT NULL,
+count integer NOT NULL,
+window_start timestamp(6) with time zone NOT NULL,
+PRIMARY KEY (ip, reason)
+);
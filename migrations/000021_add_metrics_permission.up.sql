@@ -0,0 +1,4 @@
+-- Permission to read the metrics of the API.
+INSERT INTO permissions (code)
+VALUES
+('metrics:read');
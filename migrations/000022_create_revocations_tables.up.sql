@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+id text PRIMARY KEY,
+expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS revoked_users (
+user_id bigint PRIMARY KEY,
+revoked_at timestamp(0) with time zone NOT NULL,
+expiry timestamp(0) with time zone NOT NULL
+);
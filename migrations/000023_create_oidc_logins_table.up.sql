@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS oidc_logins (
+state_hash bytea PRIMARY KEY,
+nonce text NOT NULL,
+code_verifier text NOT NULL,
+link_user_id bigint REFERENCES users ON DELETE CASCADE,
+expiry timestamp(0) with time zone NOT NULL
+);
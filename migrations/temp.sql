@@ -18,4 +18,11 @@ FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 INNER JOIN users ON users_permissions.user_id = users.id
 WHERE users.activated = true
-GROUP BY email;
\ No newline at end of file
+GROUP BY email;
+-- Roles
+-- Make faith@example.com an editor.
+INSERT INTO users_roles
+VALUES (
+(SELECT id FROM users WHERE email = 'faith@example.com'),
+(SELECT id FROM roles WHERE name = 'editor')
+);